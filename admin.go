@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminMiddleware only lets through requests bearing the admin token. Admin
+// tokens are separate from bucket tokens and grant access to the whole server.
+func adminMiddleware(adminToken string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header format must be Bearer {token}"})
+			c.Abort()
+			return
+		}
+
+		// Compare in constant time so the token can't be guessed byte by byte
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid admin token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// backupHandler streams a consistent snapshot of the database as a download.
+// The server keeps serving reads and writes while the snapshot is taken.
+func backupHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filename := fmt.Sprintf("gokv-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+
+		// Headers only reach the client with the first write, so a failure
+		// before any data is copied can still be reported as an error
+		c.Header("Content-Type", "application/vnd.sqlite3")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if err := store.Backup(c.Request.Context(), c.Writer); err != nil {
+			if c.Writer.Written() {
+				// Too late to change the status; the client sees a truncated body
+				slog.ErrorContext(c.Request.Context(), "Error streaming backup", "error", err)
+				return
+			}
+			c.Header("Content-Type", "")
+			c.Header("Content-Disposition", "")
+			if errors.Is(err, errNotSupported) {
+				c.JSON(http.StatusNotImplemented, gin.H{"error": "Backups are not supported by this storage backend"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to back up database"})
+			slog.ErrorContext(c.Request.Context(), "Error backing up database", "error", err)
+		}
+	}
+}
+
+// vacuumHandler rebuilds the database to return the space left by deleted keys
+// to the file system, and reports its size before and after. The database is
+// locked while this runs, so only one vacuum may run at a time; others are
+// turned away with 409.
+func vacuumHandler(store Store) gin.HandlerFunc {
+	var running sync.Mutex
+	return func(c *gin.Context) {
+		if !running.TryLock() {
+			c.JSON(http.StatusConflict, gin.H{"error": "A vacuum is already running"})
+			return
+		}
+		defer running.Unlock()
+
+		ctx := c.Request.Context()
+		before, err := store.Size(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(ctx, "Error reading database size", "error", err)
+			return
+		}
+
+		start := time.Now()
+		if err := store.Vacuum(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to vacuum database"})
+			slog.ErrorContext(ctx, "Error vacuuming database", "error", err)
+			return
+		}
+
+		after, err := store.Size(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(ctx, "Error reading database size", "error", err)
+			return
+		}
+		slog.InfoContext(ctx, "Vacuumed database", "bytes_before", before, "bytes_after", after, "duration", time.Since(start))
+
+		c.JSON(http.StatusOK, gin.H{"bytes_before": before, "bytes_after": after})
+	}
+}
+
+// statsHandler reports totals across all buckets, the size of the database and
+// the state of its connection pool.
+func statsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := store.Stats(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error reading stats", "error", err)
+			return
+		}
+		c.JSON(http.StatusOK, stats)
+	}
+}
+
+// adminCreateBucketHandler creates a bucket for an operator provisioning a
+// tenant. Unlike public creation, it skips email verification, the create
+// allowlist and the bucket cap, but new buckets still get the quotas in limits.
+func adminCreateBucketHandler(store Store, limits Limits) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req createBucketRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+			return
+		}
+		if req.IDPrefix != "" && !validIDPrefix(req.IDPrefix) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("id_prefix must be at most %d letters, digits, '-' or '_'", maxIDPrefixLength)})
+			return
+		}
+
+		bucketID, token, err := store.CreateBucket(c.Request.Context(), req.Email, req.IDPrefix, limits, "")
+		if err != nil {
+			if errors.Is(err, errEmailInUse) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Email address already in use"})
+				return
+			}
+			if errors.Is(err, errBucketExists) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Bucket ID already in use"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create bucket"})
+			slog.ErrorContext(c.Request.Context(), "Error creating bucket", "email", req.Email, "error", err)
+			return
+		}
+
+		slog.InfoContext(c.Request.Context(), "Created bucket", "bucket", bucketID)
+		c.JSON(http.StatusCreated, createdBucket(bucketID, token, limits, true))
+	}
+}
+
+// listBucketsHandler returns a page of buckets with their owner's email, key
+// count and total bytes stored. Tokens are never included. Pages are ordered by
+// bucket ID; pass X-Next-Cursor as ?after= to fetch the next one.
+func listBucketsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := defaultListLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer between 1 and 1000"})
+				return
+			}
+			limit = n
+		}
+
+		// Fetch one extra bucket to learn whether there is another page
+		buckets, err := store.ListBuckets(c.Request.Context(), c.Query("after"), limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error listing buckets", "error", err)
+			return
+		}
+
+		if len(buckets) > limit {
+			buckets = buckets[:limit]
+			c.Header("X-Next-Cursor", buckets[limit-1].ID)
+		}
+		c.JSON(http.StatusOK, buckets)
+	}
+}
+
+// freezeHandler freezes or unfreezes the bucket named in the path. While a
+// bucket is frozen its keys can be read but not written, e.g. during a backup
+// or migration.
+func freezeHandler(store Store, frozen bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		err := store.SetFrozen(c.Request.Context(), bucket, frozen)
+		if errors.Is(err, errNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bucket"})
+			slog.ErrorContext(c.Request.Context(), "Error freezing bucket", "bucket", bucket, "frozen", frozen, "error", err)
+			return
+		}
+
+		slog.InfoContext(c.Request.Context(), "Changed bucket state", "bucket", bucket, "frozen", frozen)
+		c.JSON(http.StatusOK, gin.H{"bucket": bucket, "frozen": frozen})
+	}
+}
+
+// setRateLimitRequest is the body of a request to set a bucket's rate limit.
+// A null rate_limit reverts the bucket to the server's limit.
+type setRateLimitRequest struct {
+	RateLimit *float64 `json:"rate_limit"`
+}
+
+// setRateLimitHandler sets the rate limit of the bucket named in the path,
+// e.g. to give a trusted bucket more throughput than the server's -rate-limit.
+func setRateLimitHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+
+		var req setRateLimitRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be a JSON object with rate_limit"})
+			return
+		}
+		var rps float64
+		if req.RateLimit != nil {
+			rps = *req.RateLimit
+			if rps <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "rate_limit must be a positive number or null"})
+				return
+			}
+		}
+
+		err := store.SetRateLimit(c.Request.Context(), bucket, rps)
+		if errors.Is(err, errNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bucket not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update bucket"})
+			slog.ErrorContext(c.Request.Context(), "Error setting bucket rate limit", "bucket", bucket, "error", err)
+			return
+		}
+
+		slog.InfoContext(c.Request.Context(), "Changed bucket rate limit", "bucket", bucket, "rate_limit", req.RateLimit)
+		c.JSON(http.StatusOK, gin.H{"bucket": bucket, "rate_limit": req.RateLimit})
+	}
+}
+
+// auditHandler returns a page of the audit log, oldest first. It can be
+// narrowed to one bucket and to a time range with since and until, given as
+// RFC 3339 timestamps. Pages are ordered by entry ID; pass X-Next-Cursor as
+// ?after= to fetch the next one.
+func auditHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := AuditQuery{Bucket: c.Query("bucket"), Limit: defaultListLimit}
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer between 1 and 1000"})
+				return
+			}
+			query.Limit = n
+		}
+		if v := c.Query("after"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "after must be an entry ID"})
+				return
+			}
+			query.After = n
+		}
+		for name, t := range map[string]*time.Time{"since": &query.Since, "until": &query.Until} {
+			if v := c.Query(name); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": name + " must be an RFC 3339 timestamp"})
+					return
+				}
+				*t = parsed
+			}
+		}
+
+		// Fetch one extra entry to learn whether there is another page
+		limit := query.Limit
+		query.Limit++
+		records, err := store.Audit(c.Request.Context(), query)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error reading audit log", "bucket", query.Bucket, "error", err)
+			return
+		}
+
+		if len(records) > limit {
+			records = records[:limit]
+			c.Header("X-Next-Cursor", strconv.FormatInt(records[limit-1].ID, 10))
+		}
+		c.JSON(http.StatusOK, records)
+	}
+}
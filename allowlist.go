@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipAllowlist is a set of networks. Single addresses are networks of one.
+type ipAllowlist []netip.Prefix
+
+// parseAllowlist parses CIDR ranges and plain IP addresses.
+func parseAllowlist(items []string) (ipAllowlist, error) {
+	var list ipAllowlist
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP address or CIDR range %q", item)
+			}
+			list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR range %q", item)
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+// allows reports whether ip lies in one of the networks.
+func (l ipAllowlist) allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	// IPv4 clients of a dual-stack listener show up as IPv4-mapped IPv6
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAllowedIP rejects requests from clients outside the allowlist with
+// 403. An empty allowlist lets everyone through. The client IP is taken from
+// X-Forwarded-For only when the request came through a trusted proxy.
+func requireAllowedIP(allowlist ipAllowlist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(allowlist) == 0 {
+			c.Next()
+			return
+		}
+		if ip := c.ClientIP(); !allowlist.allows(ip) {
+			slog.WarnContext(c.Request.Context(), "Rejected request from address outside the allowlist", "route", c.FullPath(), "client_ip", ip)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Not allowed from this address"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// errNoBlobDir is returned when reading a value stored in a file while the
+// server is running without a blob directory.
+var errNoBlobDir = errors.New("value is stored in a file but no blob directory is configured")
+
+// blobGracePeriod is how long a value file is kept after it was last written
+// even if no row refers to it, so a write that has stored its file but not yet
+// committed its row doesn't lose it to a sweep.
+const blobGracePeriod = time.Hour
+
+// blobName returns the name of the file holding stored, derived from its
+// content. Equal values share a file, and writing one again is harmless.
+func blobName(stored []byte) string {
+	sum := sha256.Sum256(stored)
+	return hex.EncodeToString(sum[:])
+}
+
+// blobPath returns where the file of a value named name is kept. Files are
+// spread over subdirectories named after the start of their name, so no
+// directory grows too large.
+func (c valueCodec) blobPath(name string) (string, error) {
+	if c.blobDir == "" {
+		return "", errNoBlobDir
+	}
+	if len(name) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid value file name %q", name)
+	}
+	return filepath.Join(c.blobDir, name[:2], name), nil
+}
+
+// writeBlob stores stored in a file and returns its name, which is what the
+// database records instead of the bytes.
+func (c valueCodec) writeBlob(stored []byte) ([]byte, error) {
+	name := blobName(stored)
+	path, err := c.blobPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A file with this name already holds these bytes; refresh its time so a
+	// sweep running alongside this write leaves it alone
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err == nil {
+		return []byte(name), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// Write to a temporary file first so a reader never sees a partial value
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(stored); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return []byte(name), nil
+}
+
+// copyBlob is like writeBlob for bytes read from r, which are copied to a file
+// as they arrive rather than held in memory, and returns the file's name and
+// how many bytes it holds.
+func (c valueCodec) copyBlob(r io.Reader) (string, int64, error) {
+	if c.blobDir == "" {
+		return "", 0, errNoBlobDir
+	}
+
+	// The name depends on the content, so the bytes are hashed on their way
+	// to a temporary file that is renamed once they are all in
+	if err := os.MkdirAll(c.blobDir, 0o700); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(c.blobDir, ".tmp-upload-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	name := hex.EncodeToString(h.Sum(nil))
+	path, err := c.blobPath(name)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", 0, err
+	}
+	// Replacing a file that already holds these bytes is harmless, and
+	// refreshes its time like writeBlob does
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return name, size, nil
+}
+
+// readBlob returns the bytes kept in the file named name.
+func (c valueCodec) readBlob(name []byte) ([]byte, error) {
+	path, err := c.blobPath(string(name))
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
+
+// openBlob opens the file named name for streaming and returns its size.
+func (c valueCodec) openBlob(name []byte) (*os.File, int64, error) {
+	path, err := c.blobPath(string(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// readBlobRange returns length bytes from offset of the file named name,
+// without reading the rest of it.
+func (c valueCodec) readBlobRange(name []byte, offset, length int64) ([]byte, error) {
+	f, _, err := c.openBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, length)
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// removeBlobs deletes the value files written before writtenBefore whose
+// names referenced doesn't hold, and returns how many were deleted.
+func (c valueCodec) removeBlobs(referenced map[string]bool, writtenBefore time.Time) (int64, error) {
+	if c.blobDir == "" {
+		return 0, nil
+	}
+	var removed int64
+	err := filepath.WalkDir(c.blobDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !info.ModTime().Before(writtenBefore) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// sweepBlobs deletes value files no longer referred to by any key or version
+// every interval until ctx is done. Files are left behind when values stored
+// in them are overwritten or removed for good.
+func sweepBlobs(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := store.PurgeBlobs(ctx, time.Now().Add(-blobGracePeriod))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error deleting unused value files", "error", err)
+			}
+			continue
+		}
+		if n > 0 {
+			slog.Info("Deleted unused value files", "count", n)
+		}
+	}
+}
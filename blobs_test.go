@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newBlobTest returns a store keeping values of at least 64 bytes in files,
+// and its codec.
+func newBlobTest(t *testing.T, maxVersions int) (Store, valueCodec) {
+	t.Helper()
+	codec := newTestCodec(t, codecOptions{BlobDir: t.TempDir(), BlobMinBytes: 64})
+	return newTestStore(t, storeOptions{Codec: codec, MaxVersions: maxVersions}), codec
+}
+
+// blobExists reports whether the file for value, stored as is, exists.
+func blobExists(t *testing.T, codec valueCodec, value []byte) bool {
+	t.Helper()
+	path, err := codec.blobPath(blobName(value))
+	if err != nil {
+		t.Fatalf("blobPath: %v", err)
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// tempFiles returns the temporary files left in the blob directory.
+func tempFiles(t *testing.T, codec valueCodec) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(codec.blobDir, ".tmp-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, _ := filepath.Glob(filepath.Join(codec.blobDir, "*", ".tmp-*"))
+	return append(matches, more...)
+}
+
+func TestStreamedUpload(t *testing.T) {
+	store, codec := newBlobTest(t, 0)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/kv", func(c *gin.Context) {
+		c.Set("bucket", "test")
+		c.Set("limits", Limits{})
+	})
+	api.GET("/:key", getHandler(store, false))
+	api.POST("/:key", putHandler(store, newSchemaCache(), 4096, 64, time.Hour))
+
+	value := make([]byte, 3000)
+	rand.Read(value)
+	req := httptest.NewRequest(http.MethodPost, "/kv/big", bytes.NewReader(value))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("POST status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+	}
+	if got, want := w.Header().Get("ETag"), etag(value); got != want {
+		t.Errorf("POST ETag = %s, want %s", got, want)
+	}
+	if !blobExists(t, codec, value) {
+		t.Errorf("no file holds the uploaded value")
+	}
+	if files := tempFiles(t, codec); len(files) > 0 {
+		t.Errorf("temporary files left behind: %q", files)
+	}
+
+	w = serve(router, http.MethodGet, "/kv/big", "")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), value) {
+		t.Errorf("GET = %d with %d bytes, want %d with the uploaded %d bytes", w.Code, w.Body.Len(), http.StatusOK, len(value))
+	}
+	if got, want := w.Header().Get("ETag"), etag(value); got != want {
+		t.Errorf("GET ETag = %s, want %s", got, want)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/kv/big", nil)
+	req.Header.Set("Range", "bytes=1000-1099")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), value[1000:1100]) {
+		t.Errorf("range GET = %d with %d bytes, want %d with bytes 1000-1099", w.Code, w.Body.Len(), http.StatusPartialContent)
+	}
+
+	// Too large an upload is cut off without leaving a file behind
+	tooLarge := make([]byte, 5000)
+	rand.Read(tooLarge)
+	req = httptest.NewRequest(http.MethodPost, "/kv/huge", bytes.NewReader(tooLarge))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized POST status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if files := tempFiles(t, codec); len(files) > 0 {
+		t.Errorf("temporary files left behind: %q", files)
+	}
+	if blobExists(t, codec, tooLarge) {
+		t.Errorf("the oversized upload was kept")
+	}
+}
+
+// TestPurgeBlobs checks that only files no entry, previous version or trashed
+// entry refers to are deleted, and only once the grace period is over.
+func TestPurgeBlobs(t *testing.T) {
+	ctx := context.Background()
+	store, codec := newBlobTest(t, 5)
+
+	value := func(name string) []byte {
+		return bytes.Repeat([]byte(name), 100)
+	}
+	put := func(key, name string) {
+		t.Helper()
+		if _, err := store.Put(ctx, "b", key, &Entry{Value: value(name)}, PutOptions{}); err != nil {
+			t.Fatalf("Put %s: %v", key, err)
+		}
+	}
+	put("live", "live")
+	put("history", "old")
+	put("history", "new")
+	put("purged", "purged")
+	if err := store.Delete(ctx, "b", "purged"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Purge(ctx, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	put("trashed", "trashed")
+	if err := store.Delete(ctx, "b", "trashed"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// A file written within the grace period is kept either way
+	n, err := store.PurgeBlobs(ctx, time.Now().Add(-blobGracePeriod))
+	if err != nil {
+		t.Fatalf("PurgeBlobs: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("PurgeBlobs within the grace period deleted %d files, want 0", n)
+	}
+
+	n, err = store.PurgeBlobs(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("PurgeBlobs: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("PurgeBlobs deleted %d files, want 1", n)
+	}
+	for _, name := range []string{"live", "old", "new", "trashed"} {
+		if !blobExists(t, codec, value(name)) {
+			t.Errorf("file of %s value was deleted", name)
+		}
+	}
+	if blobExists(t, codec, value("purged")) {
+		t.Errorf("file of purged value was kept")
+	}
+
+	// The previous version is still readable from its file
+	versions, err := store.History(ctx, "b", "history")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("History = %v, %v; want one version", versions, err)
+	}
+	old, err := store.GetVersion(ctx, "b", "history", versions[0].Version)
+	if err != nil {
+		t.Fatalf("GetVersion: %v", err)
+	}
+	if !bytes.Equal(old.Value, value("old")) {
+		t.Errorf("GetVersion returned the wrong value")
+	}
+}
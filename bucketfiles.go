@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage modes for the SQLite driver.
+const (
+	storageModeSingle    = "single"
+	storageModePerBucket = "per-bucket"
+)
+
+// bucketFileStore keeps the keys of each bucket in a SQLite file of its own,
+// bucket_<id>.db in dir, while buckets and tokens stay in a central database.
+// A corrupt file then only affects one bucket, and a bucket can be backed up or
+// removed by copying or deleting its file. Bucket files are opened on first use
+// and kept open.
+type bucketFileStore struct {
+	// Store is the central database. Calls that aren't about the keys of a
+	// bucket go to it.
+	Store
+
+	dir string
+	// blobDir holds a directory of value files per bucket, if values are
+	// kept in files.
+	blobDir string
+	open    func(bucket string) (Store, error)
+
+	mu      sync.Mutex
+	buckets map[string]Store
+}
+
+// openSQLiteBuckets opens the central database at dbFile and keeps bucket
+// files in dir, creating it if needed. Every file is opened with the same
+// options, except that each bucket keeps its value files in a directory of its
+// own so sweeping one bucket's unused files can't touch another's.
+func openSQLiteBuckets(dbFile, dir string, opts sqliteOptions, pool poolOptions, storeOpts storeOptions) (Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	central, err := openSQLite(dbFile, opts, pool, storeOpts)
+	if err != nil {
+		return nil, err
+	}
+	s := &bucketFileStore{
+		Store:   central,
+		dir:     dir,
+		blobDir: storeOpts.Codec.blobDir,
+		buckets: map[string]Store{},
+	}
+	s.open = func(bucket string) (Store, error) {
+		bucketOpts := storeOpts
+		if s.blobDir != "" {
+			bucketOpts.Codec.blobDir = s.bucketBlobDir(bucket)
+		}
+		return openSQLite(s.path(bucket), opts, pool, bucketOpts)
+	}
+	return s, nil
+}
+
+// bucketFilePrefix and bucketFileSuffix surround the bucket ID in the name of
+// its file.
+const (
+	bucketFilePrefix = "bucket_"
+	bucketFileSuffix = ".db"
+)
+
+// path returns the file holding a bucket's keys.
+func (s *bucketFileStore) path(bucket string) string {
+	return filepath.Join(s.dir, bucketFilePrefix+bucket+bucketFileSuffix)
+}
+
+// bucketBlobDir returns the directory holding a bucket's value files.
+func (s *bucketFileStore) bucketBlobDir(bucket string) string {
+	return filepath.Join(s.blobDir, bucketFilePrefix+bucket)
+}
+
+// bucket returns the store for a bucket's file, opening it on first use.
+func (s *bucketFileStore) bucket(bucket string) (Store, error) {
+	// IDs are generated by the server, but make sure one can never name a
+	// file outside dir
+	if bucket == "" || strings.ContainsAny(bucket, `/\`) || bucket == "." || bucket == ".." {
+		return nil, fmt.Errorf("invalid bucket ID %q", bucket)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if store, ok := s.buckets[bucket]; ok {
+		return store, nil
+	}
+	store, err := s.open(bucket)
+	if err != nil {
+		return nil, fmt.Errorf("opening database of bucket %s: %w", bucket, err)
+	}
+	s.buckets[bucket] = store
+	return store, nil
+}
+
+// bucketIDs returns the IDs of all buckets that have a file.
+func (s *bucketFileStore) bucketIDs() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, bucketFilePrefix) || !strings.HasSuffix(name, bucketFileSuffix) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(strings.TrimPrefix(name, bucketFilePrefix), bucketFileSuffix))
+	}
+	return ids, nil
+}
+
+// each calls fn with the store of every bucket that has a file, stopping at
+// the first error.
+func (s *bucketFileStore) each(fn func(store Store) error) error {
+	ids, err := s.bucketIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		store, err := s.bucket(id)
+		if err != nil {
+			return err
+		}
+		if err := fn(store); err != nil {
+			return fmt.Errorf("bucket %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *bucketFileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for id, store := range s.buckets {
+		errs = append(errs, store.Close())
+		delete(s.buckets, id)
+	}
+	errs = append(errs, s.Store.Close())
+	return errors.Join(errs...)
+}
+
+func (s *bucketFileStore) Vacuum(ctx context.Context) error {
+	if err := s.Store.Vacuum(ctx); err != nil {
+		return err
+	}
+	return s.each(func(store Store) error { return store.Vacuum(ctx) })
+}
+
+func (s *bucketFileStore) Size(ctx context.Context) (int64, error) {
+	total, err := s.Store.Size(ctx)
+	if err != nil {
+		return 0, err
+	}
+	err = s.each(func(store Store) error {
+		size, err := store.Size(ctx)
+		total += size
+		return err
+	})
+	return total, err
+}
+
+func (s *bucketFileStore) Stats(ctx context.Context) (*Stats, error) {
+	stats, err := s.Store.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = s.each(func(store Store) error {
+		bucketStats, err := store.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		stats.Keys += bucketStats.Keys
+		stats.Bytes += bucketStats.Bytes
+		stats.DatabaseBytes += bucketStats.DatabaseBytes
+		return nil
+	})
+	return stats, err
+}
+
+// DeleteBucket removes the bucket from the central database, then deletes its
+// file and value files.
+func (s *bucketFileStore) DeleteBucket(ctx context.Context, bucketID string) error {
+	if err := s.Store.DeleteBucket(ctx, bucketID); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if store, ok := s.buckets[bucketID]; ok {
+		store.Close()
+		delete(s.buckets, bucketID)
+	}
+	path := s.path(bucketID)
+	for _, name := range []string{path, path + "-wal", path + "-shm"} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if s.blobDir != "" {
+		return os.RemoveAll(s.bucketBlobDir(bucketID))
+	}
+	return nil
+}
+
+// Audit reads a bucket's log from its file. Without a bucket, only the
+// deletions of buckets recorded in the central database are returned.
+func (s *bucketFileStore) Audit(ctx context.Context, query AuditQuery) ([]AuditRecord, error) {
+	if query.Bucket == "" {
+		return s.Store.Audit(ctx, query)
+	}
+	if _, err := os.Stat(s.path(query.Bucket)); errors.Is(err, os.ErrNotExist) {
+		return s.Store.Audit(ctx, query)
+	}
+	store, err := s.bucket(query.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Audit(ctx, query)
+}
+
+// ListBuckets adds the usage of each bucket, read from its file, to the
+// buckets listed in the central database.
+func (s *bucketFileStore) ListBuckets(ctx context.Context, after string, limit int) ([]BucketInfo, error) {
+	buckets, err := s.Store.ListBuckets(ctx, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range buckets {
+		store, err := s.bucket(buckets[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		stats, err := store.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		buckets[i].Keys, buckets[i].Bytes = stats.Keys, stats.Bytes
+	}
+	return buckets, nil
+}
+
+func (s *bucketFileStore) Purge(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	var total int64
+	err := s.each(func(store Store) error {
+		n, err := store.Purge(ctx, deletedBefore)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+func (s *bucketFileStore) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var total int64
+	err := s.each(func(store Store) error {
+		n, err := store.DeleteExpired(ctx, now)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// PurgeBlobs sweeps the value files of every bucket. The central database
+// holds no values, and would take every bucket's files for unused ones.
+func (s *bucketFileStore) PurgeBlobs(ctx context.Context, writtenBefore time.Time) (int64, error) {
+	var total int64
+	err := s.each(func(store Store) error {
+		n, err := store.PurgeBlobs(ctx, writtenBefore)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// NormalizeKeys normalizes the keys in every bucket's file.
+func (s *bucketFileStore) NormalizeKeys(ctx context.Context, normalize func(name string) string) (int64, error) {
+	var total int64
+	err := s.each(func(store Store) error {
+		n, err := store.NormalizeKeys(ctx, normalize)
+		total += n
+		return err
+	})
+	return total, err
+}
+
+// The methods below act on the keys of one bucket and go to its file.
+
+func (s *bucketFileStore) Get(ctx context.Context, bucket, key string) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Get(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) GetRange(ctx context.Context, bucket, key string, resolve func(size int64) (offset, length int64, err error)) (*Entry, int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	return store.GetRange(ctx, bucket, key, resolve)
+}
+
+func (s *bucketFileStore) Open(ctx context.Context, bucket, key string) (*Entry, io.ReadCloser, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	return store.Open(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) Stat(ctx context.Context, bucket, key string) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Stat(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) RecordAccess(ctx context.Context, bucket, key string) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.RecordAccess(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) Touch(ctx context.Context, bucket, key string, expiresAt time.Time) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.Touch(ctx, bucket, key, expiresAt)
+}
+
+func (s *bucketFileStore) SetMetadata(ctx context.Context, bucket, key, metadata string) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.SetMetadata(ctx, bucket, key, metadata)
+}
+
+func (s *bucketFileStore) WriteBlob(ctx context.Context, bucket string, r io.Reader) (string, int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return "", 0, err
+	}
+	return store.WriteBlob(ctx, bucket, r)
+}
+
+func (s *bucketFileStore) Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (bool, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return false, err
+	}
+	return store.Put(ctx, bucket, key, entry, opts)
+}
+
+func (s *bucketFileStore) Delete(ctx context.Context, bucket, key string) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.DeleteIfMatch(ctx, bucket, key, ifMatch)
+}
+
+func (s *bucketFileStore) Release(ctx context.Context, bucket, key, token string) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.Release(ctx, bucket, key, token)
+}
+
+func (s *bucketFileStore) DeletePrefix(ctx context.Context, bucket, prefix string) (int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return store.DeletePrefix(ctx, bucket, prefix)
+}
+
+func (s *bucketFileStore) DeleteMany(ctx context.Context, bucket string, keys []string) ([]string, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.DeleteMany(ctx, bucket, keys)
+}
+
+func (s *bucketFileStore) Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Restore(ctx, bucket, key, deletedSince, limits)
+}
+
+func (s *bucketFileStore) List(ctx context.Context, bucket string, opts ListOptions) ([]string, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.List(ctx, bucket, opts)
+}
+
+func (s *bucketFileStore) ListInfo(ctx context.Context, bucket string, opts ListOptions) ([]KeyInfo, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.ListInfo(ctx, bucket, opts)
+}
+
+func (s *bucketFileStore) Count(ctx context.Context, bucket, prefix string) (int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return store.Count(ctx, bucket, prefix)
+}
+
+func (s *bucketFileStore) History(ctx context.Context, bucket, key string) ([]Version, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.History(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) GetVersion(ctx context.Context, bucket, key string, version int64) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetVersion(ctx, bucket, key, version)
+}
+
+func (s *bucketFileStore) Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Revert(ctx, bucket, key, version, limits)
+}
+
+func (s *bucketFileStore) Exists(ctx context.Context, bucket string, keys []string) (map[string]bool, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Exists(ctx, bucket, keys)
+}
+
+func (s *bucketFileStore) GetMany(ctx context.Context, bucket string, keys []string) (map[string][]byte, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.GetMany(ctx, bucket, keys)
+}
+
+func (s *bucketFileStore) PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.PutMany(ctx, bucket, entries, limits)
+}
+
+func (s *bucketFileStore) Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) ([]string, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Import(ctx, bucket, entries, overwrite, limits)
+}
+
+func (s *bucketFileStore) Export(ctx context.Context, bucket string, fn func(key string, value []byte) error) error {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return store.Export(ctx, bucket, fn)
+}
+
+func (s *bucketFileStore) Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (*Entry, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Update(ctx, bucket, key, limits, fn)
+}
+
+func (s *bucketFileStore) Push(ctx context.Context, bucket, key string, value []byte, limits Limits) (int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return store.Push(ctx, bucket, key, value, limits)
+}
+
+func (s *bucketFileStore) Items(ctx context.Context, bucket, key string) ([][]byte, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Items(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) Pop(ctx context.Context, bucket, key string) ([]byte, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return store.Pop(ctx, bucket, key)
+}
+
+func (s *bucketFileStore) Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (int64, error) {
+	store, err := s.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return store.Incr(ctx, bucket, key, delta, limits)
+}
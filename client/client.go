@@ -0,0 +1,162 @@
+// Package client is a Go client for the gokv HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Errors returned for the corresponding HTTP statuses. Use errors.Is to test
+// for them; the returned error is an *Error carrying the server's message.
+var (
+	ErrNotFound     = errors.New("gokv: not found")
+	ErrUnauthorized = errors.New("gokv: unauthorized")
+	ErrForbidden    = errors.New("gokv: forbidden")
+)
+
+// Error is returned when the server answers with an error status.
+type Error struct {
+	StatusCode int
+	// Message is the error reported by the server, if any.
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("gokv: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("gokv: %s: %s", http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is reports whether target is the sentinel error for the status code.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Client talks to a gokv server on behalf of one bucket.
+type Client struct {
+	baseURL string
+	token   string
+
+	// HTTPClient sends the requests. It defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a client for the server at baseURL, e.g.
+// "http://localhost:8080", authenticating with the bucket token.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+// Get returns the value stored at key.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, keyPath(key), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Put stores value at key, replacing any existing value.
+func (c *Client) Put(ctx context.Context, key string, value []byte) error {
+	resp, err := c.do(ctx, http.MethodPost, keyPath(key), bytes.NewReader(value), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete removes key. It returns an error matching ErrNotFound if the key
+// doesn't exist.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, keyPath(key), nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List returns the names of all keys starting with prefix, in key order. It
+// follows the server's pages until every key has been read.
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	after := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "limit": {"1000"}}
+		if after != "" {
+			query.Set("after", after)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "/kv?"+query.Encode(), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page []string
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("gokv: decoding key list: %w", err)
+		}
+		keys = append(keys, page...)
+
+		after = resp.Header.Get("X-Next-Cursor")
+		if after == "" {
+			return keys, nil
+		}
+	}
+}
+
+// keyPath returns the path of key, escaped so keys may contain slashes.
+func keyPath(key string) string {
+	return "/kv/" + url.PathEscape(key)
+}
+
+// do sends a request and turns error statuses into an *Error. On success the
+// caller must close the response body.
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&payload) == nil {
+		apiErr.Message = payload.Error
+	}
+	return nil, apiErr
+}
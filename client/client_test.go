@@ -0,0 +1,200 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testToken = "f1e2d3c4-b5a6-f7e8-d9c0-b1a2f3e4d5c6"
+
+// fakeServer is an in-memory stand-in for the parts of the gokv API the
+// client uses. It lists keys pageSize at a time.
+type fakeServer struct {
+	mu       sync.Mutex
+	values   map[string][]byte
+	pageSize int
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		writeError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/kv" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/kv/")
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		value, ok := f.values[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Key not found")
+			return
+		}
+		w.Write(value)
+	case http.MethodPost:
+		value, _ := io.ReadAll(r.Body)
+		f.values[key] = value
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if _, ok := f.values[key]; !ok {
+			writeError(w, http.StatusNotFound, "Key not found")
+			return
+		}
+		delete(f.values, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+// list writes the page of keys after the after query parameter, setting
+// X-Next-Cursor when more remain.
+func (f *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("after")
+
+	var keys []string
+	for key := range f.values {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		w.Header().Set("X-Next-Cursor", keys[len(keys)-1])
+	}
+	json.NewEncoder(w).Encode(append([]string{}, keys...))
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// newTestClient returns a client of a fake server listing pageSize keys at a
+// time.
+func newTestClient(t *testing.T, pageSize int) *Client {
+	t.Helper()
+	server := httptest.NewServer(&fakeServer{values: map[string][]byte{}, pageSize: pageSize})
+	t.Cleanup(server.Close)
+	return NewClient(server.URL+"/", testToken)
+}
+
+func TestGetPutDelete(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, 10)
+
+	if err := c.Put(ctx, "dir/greeting", []byte("hello")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	value, err := c.Get(ctx, "dir/greeting")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(value) != "hello" {
+		t.Errorf("Get = %q, want %q", value, "hello")
+	}
+
+	if err := c.Delete(ctx, "dir/greeting"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, "dir/greeting"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: err = %v, want ErrNotFound", err)
+	}
+	if err := c.Delete(ctx, "dir/greeting"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete of missing key: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestListFollowsCursor(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, 2)
+
+	want := []string{"a/1", "a/2", "a/3", "a/4", "a/5"}
+	for _, key := range append([]string{"b/1", "0"}, want...) {
+		if err := c.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+	}
+
+	keys, err := c.List(ctx, "a/")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !slices.Equal(keys, want) {
+		t.Errorf("List = %q, want %q", keys, want)
+	}
+
+	keys, err = c.List(ctx, "none/")
+	if err != nil {
+		t.Fatalf("List of empty prefix: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("List of empty prefix = %q, want none", keys)
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeError(w, tt.status, "Nope")
+			}))
+			defer server.Close()
+
+			_, err := NewClient(server.URL, testToken).Get(context.Background(), "k")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("err = %T, want *Error", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Message != "Nope" {
+				t.Errorf("Error = {%d %q}, want {%d %q}", apiErr.StatusCode, apiErr.Message, tt.status, "Nope")
+			}
+			for _, other := range tests {
+				if other.want != tt.want && errors.Is(err, other.want) {
+					t.Errorf("err also matches %v", other.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWrongToken(t *testing.T) {
+	server := httptest.NewServer(&fakeServer{values: map[string][]byte{}, pageSize: 10})
+	defer server.Close()
+
+	_, err := NewClient(server.URL, "wrong").List(context.Background(), "")
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("err = %v, want ErrUnauthorized", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Command gokv-cli reads and writes keys of a gokv bucket from the shell.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/codingric/gokv/client"
+)
+
+const usage = `Usage: gokv-cli [flags] <command> [args]
+
+Commands:
+  get <key>          print the value of key
+  set <key> [value]  store value at key, read from stdin if not given
+  del <key>          delete key
+  ls [prefix]        list keys, one per line
+
+Flags:
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	endpoint := flag.String("endpoint", envOr("GOKV_ENDPOINT", "http://localhost:8080"), "gokv server URL (env GOKV_ENDPOINT)")
+	// The token isn't used as the flag default so -h doesn't print it
+	token := flag.String("token", "", "bucket token (env GOKV_TOKEN)")
+	flag.Parse()
+	if *token == "" {
+		*token = os.Getenv("GOKV_TOKEN")
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		fatal("a token is required, set -token or GOKV_TOKEN")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c := client.NewClient(*endpoint, *token)
+	if err := run(ctx, c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fatal(describe(err, flag.Args()[1:]))
+	}
+}
+
+// run executes the command with its arguments.
+func run(ctx context.Context, c *client.Client, command string, args []string) error {
+	switch command {
+	case "get":
+		if len(args) != 1 {
+			return errUsage
+		}
+		value, err := c.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(value)
+		return err
+
+	case "set":
+		if len(args) != 1 && len(args) != 2 {
+			return errUsage
+		}
+		var value []byte
+		if len(args) == 2 {
+			value = []byte(args[1])
+		} else {
+			var err error
+			if value, err = io.ReadAll(os.Stdin); err != nil {
+				return err
+			}
+		}
+		return c.Put(ctx, args[0], value)
+
+	case "del":
+		if len(args) != 1 {
+			return errUsage
+		}
+		return c.Delete(ctx, args[0])
+
+	case "ls":
+		if len(args) > 1 {
+			return errUsage
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		keys, err := c.List(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// errUsage is returned when a command is given the wrong arguments.
+var errUsage = errors.New("wrong number of arguments, see gokv-cli -h")
+
+// describe turns err into a message for the user, naming the key for errors
+// about it.
+func describe(err error, args []string) string {
+	switch {
+	case errors.Is(err, client.ErrNotFound) && len(args) > 0:
+		return fmt.Sprintf("key %q not found", args[0])
+	case errors.Is(err, client.ErrUnauthorized):
+		return "authentication failed, check the token"
+	case errors.Is(err, client.ErrForbidden):
+		return "permission denied: " + err.Error()
+	}
+	return err.Error()
+}
+
+// envOr returns the value of the environment variable name, or def if it is
+// unset.
+func envOr(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	return def
+}
+
+// fatal prints msg to stderr and exits with status 1.
+func fatal(msg string) {
+	fmt.Fprintln(os.Stderr, "gokv-cli:", msg)
+	os.Exit(1)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Bits of the value_flags column describing how a value is stored. Rows
+// written before a feature was enabled have its bit clear, so old and new rows
+// can be read side by side.
+const (
+	valueEncrypted = 1 << iota
+	valueGzip
+	valueZstd
+	// valueFile means the column holds the name of the file the value is
+	// kept in, rather than the value itself.
+	valueFile
+)
+
+// errNoEncryptionKey is returned when reading an encrypted value while the
+// server is running without an encryption key.
+var errNoEncryptionKey = errors.New("value is encrypted but no encryption key is configured")
+
+// codecOptions configures how values are stored.
+type codecOptions struct {
+	// EncryptionKey is a base64-encoded 32-byte AES key. Values are stored
+	// unencrypted when it is empty.
+	EncryptionKey string
+	// Compression is "gzip", "zstd" or empty for none.
+	Compression string
+	// CompressMinBytes is the size from which values are compressed.
+	CompressMinBytes int
+	// BlobDir is the directory values of at least BlobMinBytes are kept in
+	// as files. All values are kept in the database when it is empty.
+	BlobDir      string
+	BlobMinBytes int
+}
+
+// valueCodec transforms values on their way into and out of the database. The
+// zero value stores values as is.
+type valueCodec struct {
+	// aead encrypts values when set.
+	aead cipher.AEAD
+	// compression is the flag of the algorithm to compress values of at
+	// least compressMinBytes with, or 0 for none.
+	compression      int64
+	compressMinBytes int
+	// blobDir holds the files of values of at least blobMinBytes, as
+	// stored, when set.
+	blobDir      string
+	blobMinBytes int
+}
+
+// zstdEncoder and zstdDecoder are created on first use and are safe for
+// concurrent use. Decoding doesn't depend on the current settings, since
+// compressed rows remain after compression is turned off.
+var (
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		enc, _ := zstd.NewWriter(nil)
+		return enc
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+)
+
+// newValueCodec returns a codec for opts, or an error describing which option
+// is invalid.
+func newValueCodec(opts codecOptions) (valueCodec, error) {
+	var c valueCodec
+
+	switch opts.Compression {
+	case "":
+	case "gzip":
+		c.compression = valueGzip
+	case "zstd":
+		c.compression = valueZstd
+	default:
+		return valueCodec{}, fmt.Errorf("compression must be gzip or zstd, not %q", opts.Compression)
+	}
+	if opts.CompressMinBytes < 0 {
+		return valueCodec{}, fmt.Errorf("compression threshold must not be negative")
+	}
+	c.compressMinBytes = opts.CompressMinBytes
+
+	if opts.BlobMinBytes < 1 {
+		return valueCodec{}, fmt.Errorf("blob threshold must be at least 1 byte")
+	}
+	if opts.BlobDir != "" {
+		if err := os.MkdirAll(opts.BlobDir, 0o700); err != nil {
+			return valueCodec{}, err
+		}
+	}
+	c.blobDir, c.blobMinBytes = opts.BlobDir, opts.BlobMinBytes
+
+	if opts.EncryptionKey == "" {
+		return c, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(opts.EncryptionKey)
+	if err != nil || len(raw) != 32 {
+		return valueCodec{}, fmt.Errorf("encryption key must be 32 bytes, base64-encoded")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return valueCodec{}, err
+	}
+	c.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return valueCodec{}, err
+	}
+	return c, nil
+}
+
+// additionalData ties a ciphertext to the key it was written to, so it can't
+// be passed off as the value of another key.
+func additionalData(bucket, key string) []byte {
+	return []byte(bucket + "\x00" + key)
+}
+
+// encode returns the bytes to store for the value of key, and the flags
+// describing them. Values are compressed before they are encrypted, as
+// ciphertext doesn't compress, and large ones are then moved to a file.
+func (c valueCodec) encode(bucket, key string, value []byte) ([]byte, int64, error) {
+	stored := value
+	var flags int64
+
+	if c.compression != 0 && len(value) >= c.compressMinBytes {
+		compressed, err := compress(c.compression, value)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Values that don't shrink are kept as they are
+		if len(compressed) < len(value) {
+			stored = compressed
+			flags |= c.compression
+		}
+	}
+
+	if c.aead != nil {
+		// The random nonce is stored in front of the ciphertext
+		nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(stored)+c.aead.Overhead())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, 0, err
+		}
+		stored = c.aead.Seal(nonce, nonce, stored, additionalData(bucket, key))
+		flags |= valueEncrypted
+	}
+
+	if c.blobDir != "" && len(stored) >= c.blobMinBytes {
+		name, err := c.writeBlob(stored)
+		if err != nil {
+			return nil, 0, err
+		}
+		stored = name
+		flags |= valueFile
+	}
+	return stored, flags, nil
+}
+
+// decode reverses encode, given the stored bytes and their flags.
+func (c valueCodec) decode(bucket, key string, stored []byte, flags int64) ([]byte, error) {
+	value := stored
+	if flags&valueFile != 0 {
+		var err error
+		if value, err = c.readBlob(stored); err != nil {
+			return nil, err
+		}
+	}
+	if flags&valueEncrypted != 0 {
+		if c.aead == nil {
+			return nil, errNoEncryptionKey
+		}
+		n := c.aead.NonceSize()
+		if len(value) < n {
+			return nil, errors.New("encrypted value is truncated")
+		}
+		var err error
+		value, err = c.aead.Open(nil, value[:n], value[n:], additionalData(bucket, key))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case flags&valueGzip != 0:
+		r, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case flags&valueZstd != 0:
+		return zstdDecoder().DecodeAll(value, nil)
+	}
+	return value, nil
+}
+
+// compress compresses value with the algorithm given by its flag.
+func compress(algorithm int64, value []byte) ([]byte, error) {
+	if algorithm == valueZstd {
+		return zstdEncoder().EncodeAll(value, nil), nil
+	}
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testEncryptionKey returns a valid -encryption-key made of b repeated.
+func testEncryptionKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+// newTestCodec returns a codec for opts, failing the test if they're invalid.
+func newTestCodec(t *testing.T, opts codecOptions) valueCodec {
+	t.Helper()
+	if opts.BlobMinBytes == 0 {
+		opts.BlobMinBytes = 1 << 20
+	}
+	c, err := newValueCodec(opts)
+	if err != nil {
+		t.Fatalf("newValueCodec: %v", err)
+	}
+	return c
+}
+
+func TestEncryptionKeyValidated(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"none", "", true},
+		{"32 bytes", testEncryptionKey(1), true},
+		{"16 bytes", base64.StdEncoding.EncodeToString(make([]byte, 16)), false},
+		{"33 bytes", base64.StdEncoding.EncodeToString(make([]byte, 33)), false},
+		{"not base64", strings.Repeat("!", 44), false},
+		{"raw 32 bytes", strings.Repeat("k", 32), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newValueCodec(codecOptions{EncryptionKey: tt.key, BlobMinBytes: 1})
+			if (err == nil) != tt.ok {
+				t.Errorf("newValueCodec error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	values := map[string][]byte{
+		"empty":        {},
+		"short":        []byte("secret value"),
+		"compressible": bytes.Repeat([]byte("secret value "), 1000),
+	}
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		c := newTestCodec(t, codecOptions{EncryptionKey: testEncryptionKey(1), Compression: compression, CompressMinBytes: 64})
+		for name, value := range values {
+			t.Run(compression+"/"+name, func(t *testing.T) {
+				stored, flags, err := c.encode("b", "k", value)
+				if err != nil {
+					t.Fatalf("encode: %v", err)
+				}
+				if flags&valueEncrypted == 0 {
+					t.Errorf("flags = %b, want encrypted", flags)
+				}
+				if len(value) > 0 && bytes.Contains(stored, value[:min(len(value), 12)]) {
+					t.Errorf("stored bytes contain the plaintext")
+				}
+				got, err := c.decode("b", "k", stored, flags)
+				if err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if !bytes.Equal(got, value) {
+					t.Errorf("decode = %q, want %q", got, value)
+				}
+			})
+		}
+	}
+}
+
+func TestDecryptRefused(t *testing.T) {
+	c := newTestCodec(t, codecOptions{EncryptionKey: testEncryptionKey(1)})
+	stored, flags, err := c.encode("b", "k", []byte("secret value"))
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	if _, err := newTestCodec(t, codecOptions{EncryptionKey: testEncryptionKey(2)}).decode("b", "k", stored, flags); err == nil {
+		t.Errorf("decode with the wrong encryption key succeeded")
+	}
+	if _, err := newTestCodec(t, codecOptions{}).decode("b", "k", stored, flags); !errors.Is(err, errNoEncryptionKey) {
+		t.Errorf("decode without an encryption key: err = %v, want errNoEncryptionKey", err)
+	}
+	// A ciphertext only decrypts as the value of the key it was written to
+	if _, err := c.decode("b", "other", stored, flags); err == nil {
+		t.Errorf("decode as another key succeeded")
+	}
+	if _, err := c.decode("other", "k", stored, flags); err == nil {
+		t.Errorf("decode as another bucket's key succeeded")
+	}
+	if _, err := c.decode("b", "k", stored[:5], flags); err == nil {
+		t.Errorf("decode of a truncated value succeeded")
+	}
+	tampered := bytes.Clone(stored)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := c.decode("b", "k", tampered, flags); err == nil {
+		t.Errorf("decode of a tampered value succeeded")
+	}
+}
+
+// TestNormalizeKeysReencrypts checks that renaming keys re-encrypts their
+// values and previous versions for the new name, which the ciphertexts are
+// bound to.
+func TestNormalizeKeysReencrypts(t *testing.T) {
+	ctx := context.Background()
+	codec := newTestCodec(t, codecOptions{EncryptionKey: testEncryptionKey(1)})
+	store := newTestStore(t, storeOptions{Codec: codec, MaxVersions: 5})
+
+	for _, value := range []string{"first", "second"} {
+		if _, err := store.Put(ctx, "b", "Secret", &Entry{Key: "Secret", Value: []byte(value)}, PutOptions{}); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+
+	renamed, err := store.NormalizeKeys(ctx, strings.ToLower)
+	if err != nil {
+		t.Fatalf("NormalizeKeys: %v", err)
+	}
+	if renamed != 1 {
+		t.Errorf("NormalizeKeys renamed %d keys, want 1", renamed)
+	}
+
+	entry, err := store.Get(ctx, "b", "secret")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if string(entry.Value) != "second" {
+		t.Errorf("Get = %q, want %q", entry.Value, "second")
+	}
+	versions, err := store.History(ctx, "b", "secret")
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(versions) != 1 {
+		t.Fatalf("History has %d versions, want 1", len(versions))
+	}
+	old, err := store.GetVersion(ctx, "b", "secret", versions[0].Version)
+	if err != nil {
+		t.Fatalf("GetVersion: %v", err)
+	}
+	if string(old.Value) != "first" {
+		t.Errorf("GetVersion = %q, want %q", old.Value, "first")
+	}
+
+	// Nothing is left readable under the old name
+	if _, err := store.Get(ctx, "b", "Secret"); !errors.Is(err, errNotFound) {
+		t.Errorf("Get of the old name: err = %v, want errNotFound", err)
+	}
+}
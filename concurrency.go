@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// concurrencyMiddleware sheds load by answering 503 once limit requests are
+// in flight, rather than letting them queue up. Routes in exempt, such as
+// health checks and streams that stay open, neither count towards the limit
+// nor are turned away.
+func concurrencyMiddleware(limit int, exempt ...string) gin.HandlerFunc {
+	skip := map[string]bool{}
+	for _, route := range exempt {
+		skip[route] = true
+	}
+	slots := make(chan struct{}, limit)
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is busy, try again"})
+			return
+		}
+		defer func() { <-slots }()
+
+		c.Next()
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// envPrefix starts the name of the environment variable for every flag, e.g.
+// GOKV_MAX_VALUE_BYTES for -max-value-bytes.
+const envPrefix = "GOKV_"
+
+// envName returns the environment variable that sets the named flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig fills in the flags of fs that weren't given on the command line,
+// first from GOKV_* environment variables and then from the config file named
+// by -config, if any. Flags therefore take precedence over the environment,
+// which takes precedence over the file, which takes precedence over defaults.
+// fs must already have been parsed.
+func loadConfig(fs *flag.FlagSet, configFlag string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			return
+		}
+		set[f.Name] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	path := fs.Lookup(configFlag).Value.String()
+	if path == "" {
+		return nil
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Report problems in a stable order
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Keys may be written like the flags or with underscores
+		flagName := strings.ReplaceAll(name, "_", "-")
+		if flagName == configFlag || fs.Lookup(flagName) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		if set[flagName] {
+			continue
+		}
+		value, err := configValue(values[name])
+		if err != nil {
+			return fmt.Errorf("%s: option %q: %w", path, name, err)
+		}
+		if err := fs.Set(flagName, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for option %q: %w", path, value, name, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile parses a flat YAML or TOML file of option names and values.
+// The format is chosen by the file extension, defaulting to YAML.
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+
+	values := map[string]any{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// configValue converts a value from a config file to the string form a flag
+// accepts. Lists, e.g. of allowed origins, become comma-separated.
+func configValue(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", fmt.Errorf("nested options are not supported")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsAllowedMethods and corsAllowedHeaders are what browsers may use in
+// cross-origin requests; corsExposedHeaders are the response headers scripts
+// may read.
+var (
+	corsAllowedMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Match", "If-Modified-Since", "If-None-Match", "Range", "X-Append-Separator", "X-Metadata", "X-Request-ID", "X-TTL-Seconds", "X-Write-Timestamp"}
+	corsExposedHeaders = []string{"Accept-Ranges", "Content-Range", "ETag", "Idempotent-Replayed", "Last-Modified", "Location", "Retry-After", "X-Created-At", "X-Metadata", "X-Next-Cursor", "X-Request-ID", "X-Write-Timestamp"}
+)
+
+// corsMiddleware adds CORS headers for requests from the allowed origins and
+// answers preflight requests. An origin of "*" allows any origin.
+func corsMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !allowed[origin] && !allowed["*"] {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+		// Answer preflight requests here; they carry no token and match no route
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+			c.Header("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			c.Header("Access-Control-Max-Age", "600")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// preflightHandler answers OPTIONS requests for the authenticated routes
+// without a token. Browsers never send credentials with a preflight, so it
+// must not reach authMiddleware; when CORS is enabled corsMiddleware has
+// already answered it with the CORS headers.
+func preflightHandler() gin.HandlerFunc {
+	allow := strings.Join(append([]string{http.MethodOptions}, corsAllowedMethods...), ", ")
+	return func(c *gin.Context) {
+		c.Header("Allow", allow)
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"time"
+)
+
+// envelopeContentType marks a write whose body is a putEnvelope rather than
+// the value itself.
+const envelopeContentType = "application/vnd.gokv+json"
+
+// putEnvelope wraps a value along with the options that are otherwise sent in
+// headers, for clients that can't set custom headers.
+type putEnvelope struct {
+	Value       *string         `json:"value"`
+	ContentType string          `json:"content_type"`
+	TTL         *int64          `json:"ttl"`
+	Metadata    json.RawMessage `json:"metadata"`
+}
+
+// isEnvelope reports whether a request's Content-Type marks its body as a
+// putEnvelope.
+func isEnvelope(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == envelopeContentType
+}
+
+// parseEnvelope decodes and checks a putEnvelope. It returns a message
+// describing the problem if body is not a valid envelope.
+func parseEnvelope(body []byte) (*putEnvelope, string) {
+	var env putEnvelope
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&env); err != nil || dec.More() || env.Value == nil {
+		return nil, "Envelope must be a JSON object with a string value and optional content_type, ttl and metadata"
+	}
+	if env.TTL != nil {
+		if _, ok := ttlDuration(*env.TTL); !ok {
+			return nil, fmt.Sprintf("Envelope ttl must be a positive integer of at most %d", maxTTLSeconds)
+		}
+	}
+	if len(env.Metadata) > maxMetadataBytes {
+		return nil, fmt.Sprintf("Envelope metadata exceeds the maximum size of %d bytes", maxMetadataBytes)
+	}
+	return &env, ""
+}
+
+// expiresAt returns when a value written now with the envelope's TTL expires,
+// or the zero time if it has none.
+func (env *putEnvelope) expiresAt() time.Time {
+	if env.TTL == nil {
+		return time.Time{}
+	}
+	ttl, _ := ttlDuration(*env.TTL)
+	return time.Now().Add(ttl)
+}
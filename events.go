@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of change events.
+const (
+	eventPut    = "put"
+	eventDelete = "delete"
+)
+
+// event describes a change to a key. A delete event with Prefix set removed
+// every key starting with Key.
+type event struct {
+	Type   string
+	Bucket string
+	Key    string
+	Prefix bool
+	Value  []byte
+	// NoValue is set on a put whose value was streamed to a file, which
+	// isn't read back into memory to publish it.
+	NoValue bool
+}
+
+// matches reports whether the event affects key.
+func (e event) matches(key string) bool {
+	if e.Prefix {
+		return strings.HasPrefix(key, e.Key)
+	}
+	return e.Key == key
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by before
+// it is dropped.
+const subscriberBuffer = 16
+
+// subscription receives the events for one key. Its channel is closed when the
+// subscriber falls too far behind or the hub shuts down.
+type subscription struct {
+	bucket string
+	key    string
+	C      chan event
+}
+
+// hub is an in-process publish/subscribe broker for change events. Besides
+// per-key subscriptions, listeners receive every event.
+type hub struct {
+	// keys normalizes the keys of events and subscriptions, so events are
+	// published under one name however the key was spelled.
+	keys      keyNormalizer
+	mu        sync.Mutex
+	closed    bool
+	subs      map[string]map[*subscription]struct{}
+	listeners []func(event)
+}
+
+// newHub returns an empty hub for keys normalized by keys.
+func newHub(keys keyNormalizer) *hub {
+	return &hub{keys: keys, subs: map[string]map[*subscription]struct{}{}}
+}
+
+// subscribe starts delivering the events for a key. The subscription must be
+// ended with unsubscribe.
+func (h *hub) subscribe(bucket, key string) *subscription {
+	sub := &subscription{bucket: bucket, key: h.keys.normalize(key), C: make(chan event, subscriberBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(sub.C)
+		return sub
+	}
+	if h.subs[bucket] == nil {
+		h.subs[bucket] = map[*subscription]struct{}{}
+	}
+	h.subs[bucket][sub] = struct{}{}
+	return sub
+}
+
+// listen registers fn to be called with every event. fn is called while
+// publishing, so it must not block.
+func (h *hub) listen(fn func(event)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = append(h.listeners, fn)
+}
+
+// unsubscribe stops delivering events to sub.
+func (h *hub) unsubscribe(sub *subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(sub)
+}
+
+// remove drops sub and closes its channel. h.mu must be held.
+func (h *hub) remove(sub *subscription) {
+	subs, ok := h.subs[sub.bucket]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(h.subs, sub.bucket)
+	}
+	close(sub.C)
+}
+
+// publish delivers ev to the subscribers of the keys it affects without
+// blocking. Subscribers that can't keep up are dropped rather than slowing
+// down writers.
+func (h *hub) publish(ev event) {
+	ev.Key = h.keys.normalize(ev.Key)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, fn := range h.listeners {
+		fn(ev)
+	}
+	for sub := range h.subs[ev.Bucket] {
+		if !ev.matches(sub.key) {
+			continue
+		}
+		select {
+		case sub.C <- ev:
+		default:
+			h.remove(sub)
+		}
+	}
+}
+
+// close ends every subscription, e.g. so streaming responses finish when the
+// server shuts down.
+func (h *hub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for _, subs := range h.subs {
+		for sub := range subs {
+			h.remove(sub)
+		}
+	}
+}
+
+// publishingStore wraps a Store to publish an event to the hub for every
+// successful change.
+type publishingStore struct {
+	Store
+	hub *hub
+}
+
+func (s publishingStore) Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (bool, error) {
+	created, err := s.Store.Put(ctx, bucket, key, entry, opts)
+	if err != nil || opts.DryRun {
+		return created, err
+	}
+	s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entry.Value, NoValue: entry.Blob != ""})
+	return created, nil
+}
+
+func (s publishingStore) Delete(ctx context.Context, bucket, key string) error {
+	if err := s.Store.Delete(ctx, bucket, key); err != nil {
+		return err
+	}
+	s.hub.publish(event{Type: eventDelete, Bucket: bucket, Key: key})
+	return nil
+}
+
+func (s publishingStore) DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) error {
+	if err := s.Store.DeleteIfMatch(ctx, bucket, key, ifMatch); err != nil {
+		return err
+	}
+	s.hub.publish(event{Type: eventDelete, Bucket: bucket, Key: key})
+	return nil
+}
+
+func (s publishingStore) Release(ctx context.Context, bucket, key, token string) error {
+	if err := s.Store.Release(ctx, bucket, key, token); err != nil {
+		return err
+	}
+	s.hub.publish(event{Type: eventDelete, Bucket: bucket, Key: key})
+	return nil
+}
+
+func (s publishingStore) DeletePrefix(ctx context.Context, bucket, prefix string) (int64, error) {
+	n, err := s.Store.DeletePrefix(ctx, bucket, prefix)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		s.hub.publish(event{Type: eventDelete, Bucket: bucket, Key: prefix, Prefix: true})
+	}
+	return n, nil
+}
+
+func (s publishingStore) DeleteMany(ctx context.Context, bucket string, keys []string) ([]string, error) {
+	deleted, err := s.Store.DeleteMany(ctx, bucket, keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range deleted {
+		s.hub.publish(event{Type: eventDelete, Bucket: bucket, Key: key})
+	}
+	return deleted, nil
+}
+
+func (s publishingStore) Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (*Entry, error) {
+	entry, err := s.Store.Restore(ctx, bucket, key, deletedSince, limits)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entry.Value})
+	return entry, nil
+}
+
+func (s publishingStore) Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (*Entry, error) {
+	entry, err := s.Store.Revert(ctx, bucket, key, version, limits)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entry.Value})
+	return entry, nil
+}
+
+func (s publishingStore) DeleteBucket(ctx context.Context, bucketID string) error {
+	if err := s.Store.DeleteBucket(ctx, bucketID); err != nil {
+		return err
+	}
+	s.hub.publish(event{Type: eventDelete, Bucket: bucketID, Prefix: true})
+	return nil
+}
+
+func (s publishingStore) PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) error {
+	if err := s.Store.PutMany(ctx, bucket, entries, limits); err != nil {
+		return err
+	}
+	for key, entry := range entries {
+		s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entry.Value})
+	}
+	return nil
+}
+
+func (s publishingStore) Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) ([]string, error) {
+	written, err := s.Store.Import(ctx, bucket, entries, overwrite, limits)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range written {
+		s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entries[key].Value})
+	}
+	return written, nil
+}
+
+func (s publishingStore) Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (*Entry, error) {
+	entry, err := s.Store.Update(ctx, bucket, key, limits, fn)
+	if err != nil {
+		return nil, err
+	}
+	s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: entry.Value})
+	return entry, nil
+}
+
+func (s publishingStore) Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (int64, error) {
+	value, err := s.Store.Incr(ctx, bucket, key, delta, limits)
+	if err != nil {
+		return 0, err
+	}
+	s.hub.publish(event{Type: eventPut, Bucket: bucket, Key: key, Value: []byte(strconv.FormatInt(value, 10))})
+	return value, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTTLSeconds is the longest TTL a key can be given: the most whole seconds
+// a time.Duration can hold, about 292 years.
+const maxTTLSeconds = math.MaxInt64 / int64(time.Second)
+
+// invalidTTLMessage is the error for an X-TTL-Seconds header parseTTL refuses.
+var invalidTTLMessage = fmt.Sprintf("X-TTL-Seconds must be a positive integer of at most %d", maxTTLSeconds)
+
+// ttlDuration converts a TTL in seconds to a duration. It returns false if
+// seconds isn't positive or is more than maxTTLSeconds, which would overflow.
+func ttlDuration(seconds int64) (time.Duration, bool) {
+	if seconds <= 0 || seconds > maxTTLSeconds {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// parseTTL parses a TTL given in seconds, as in an X-TTL-Seconds header.
+func parseTTL(v string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return ttlDuration(seconds)
+}
+
+// sweepExpired permanently removes expired keys every interval until ctx is
+// done. Expired keys are never served, but without this they would take up
+// space until they are read or overwritten.
+func sweepExpired(ctx context.Context, store Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := store.DeleteExpired(ctx, time.Now())
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error deleting expired keys", "error", err)
+			}
+			continue
+		}
+		if n > 0 {
+			slog.Info("Deleted expired keys", "count", n)
+		}
+	}
+}
+
+// ttlHandler returns how many seconds a key has left before it expires, or -1
+// if it never expires, like Redis' TTL.
+func ttlHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		entry, err := store.Stat(c.Request.Context(), bucket, key)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error reading key TTL", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		ttl := int64(-1)
+		if !entry.ExpiresAt.IsZero() {
+			ttl = max(entry.ExpiresAt.Unix()-time.Now().Unix(), 0)
+		}
+		c.JSON(http.StatusOK, gin.H{"ttl": ttl})
+	}
+}
+
+// touchHandler makes a key expire X-TTL-Seconds from now, without rewriting
+// its value, like Redis' EXPIRE. Keys that have already expired stay expired.
+func touchHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		ttl, ok := parseTTL(c.GetHeader("X-TTL-Seconds"))
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": invalidTTLMessage})
+			return
+		}
+
+		expiresAt := time.Now().Add(ttl)
+		if err := store.Touch(c.Request.Context(), bucket, key, expiresAt); err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error touching key", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ttl": int64(ttl / time.Second), "expires_at": expiresAt.UTC().Format(time.RFC3339)})
+	}
+}
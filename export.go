@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// exportRecord is one line of an NDJSON export.
+type exportRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// wantsNDJSON reports whether the client asked for newline-delimited JSON,
+// either with ?format=ndjson or through the Accept header.
+func wantsNDJSON(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "ndjson"
+	}
+	return strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+}
+
+// exportHandler streams every key and value in the bucket, either as a single
+// JSON object mapping keys to values or, for ?format=ndjson, as one
+// {"key":...,"value":...} object per line. Rows are written as they are read
+// so large buckets are never held in memory.
+func exportHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		ndjson := wantsNDJSON(c)
+
+		// Nothing is written until the first row arrives, so a failed query
+		// can still be reported with an error status
+		started := false
+		start := func() {
+			started = true
+			if ndjson {
+				c.Header("Content-Type", "application/x-ndjson")
+			} else {
+				c.Header("Content-Type", "application/json")
+				c.Writer.WriteString("{")
+			}
+			c.Status(http.StatusOK)
+		}
+
+		err := store.Export(c.Request.Context(), bucket, func(key string, value []byte) error {
+			first := !started
+			if first {
+				start()
+			}
+
+			if ndjson {
+				line, err := json.Marshal(exportRecord{Key: key, Value: string(value)})
+				if err != nil {
+					return err
+				}
+				_, err = c.Writer.Write(append(line, '\n'))
+				return err
+			}
+
+			k, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			v, err := json.Marshal(string(value))
+			if err != nil {
+				return err
+			}
+			if !first {
+				c.Writer.WriteString(",")
+			}
+			c.Writer.Write(k)
+			c.Writer.WriteString(":")
+			_, err = c.Writer.Write(v)
+			return err
+		})
+		if err != nil {
+			if started {
+				// Too late to change the status; the client sees a truncated body
+				slog.ErrorContext(c.Request.Context(), "Error streaming export", "bucket", bucket, "error", err)
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error exporting bucket", "bucket", bucket, "error", err)
+			return
+		}
+
+		if !started {
+			start()
+		}
+		if !ndjson {
+			c.Writer.WriteString("}")
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package gokvpb holds the gRPC service definition of gokv and the code
+// generated from it.
+package gokvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gokv.proto
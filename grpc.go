@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codingric/gokv/gokvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer implements the gRPC KV service on top of the same Store, hub and
+// checks as the HTTP API, so both protocols see and enforce the same things.
+type grpcServer struct {
+	gokvpb.UnimplementedKVServer
+
+	store         Store
+	events        *hub
+	keys          keyValidator
+	schemas       *schemaCache
+	maxValueBytes int64
+	trackAccess   bool
+	// limiter limits the rate of calls per bucket, sharing each bucket's
+	// allowance with its HTTP requests. Calls aren't limited when it is nil.
+	limiter *rateLimiter
+}
+
+// newGRPCServer returns a gRPC server with the KV service registered. Every
+// call is authenticated with a bucket token and rate limited, like
+// authMiddleware and rateLimitMiddleware do for HTTP requests.
+func newGRPCServer(s *grpcServer, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.UnaryInterceptor(s.authUnary),
+		grpc.StreamInterceptor(s.authStream),
+		// Leave room for the key and framing so oversized values get a
+		// clear error from Put
+		grpc.MaxRecvMsgSize(int(s.maxValueBytes)+maxKeyLength+1024),
+	)
+	srv := grpc.NewServer(opts...)
+	gokvpb.RegisterKVServer(srv, s)
+	return srv
+}
+
+// authContextKey is the context key under which the Auth of a call is stored.
+type authContextKey struct{}
+
+// authenticate validates the bearer token in the call's "authorization"
+// metadata and returns the Auth it grants, unless the bucket has exceeded its
+// rate, which fails the call with ResourceExhausted and a "retry-after"
+// header in seconds.
+func (s *grpcServer) authenticate(ctx context.Context) (*Auth, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Authorization metadata required")
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return nil, status.Error(codes.Unauthenticated, "Authorization metadata format must be Bearer {token}")
+	}
+
+	auth, err := s.store.ValidateToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "Invalid token")
+		}
+		slog.ErrorContext(ctx, "Error authenticating token", "error", err)
+		return nil, status.Error(codes.Internal, "Database error during authentication")
+	}
+	if !auth.Verified {
+		return nil, status.Error(codes.PermissionDenied, "Bucket email address not verified")
+	}
+	if s.limiter != nil {
+		if retryAfter, ok := s.limiter.allow(auth.BucketID, auth.RateLimit); !ok {
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter)))
+			return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+		}
+	}
+	return auth, nil
+}
+
+// authUnary authenticates unary calls.
+func (s *grpcServer) authUnary(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	auth, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, authContextKey{}, auth), req)
+}
+
+// authStream authenticates streaming calls.
+func (s *grpcServer) authStream(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	auth, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, authedStream{stream, context.WithValue(stream.Context(), authContextKey{}, auth)})
+}
+
+// authedStream is a server stream whose context carries the call's Auth.
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authedStream) Context() context.Context {
+	return s.ctx
+}
+
+// callAuth returns the Auth of an authenticated call.
+func callAuth(ctx context.Context) *Auth {
+	auth, _ := ctx.Value(authContextKey{}).(*Auth)
+	return auth
+}
+
+// requireWritable fails calls that write to the bucket with a read-only token
+// or while the bucket is frozen.
+func requireWritable(auth *Auth) error {
+	if auth.Scope == scopeReadOnly {
+		return status.Error(codes.PermissionDenied, "Token is read-only")
+	}
+	if auth.Frozen {
+		return status.Error(codes.FailedPrecondition, frozenMessage)
+	}
+	return nil
+}
+
+func (s *grpcServer) Get(ctx context.Context, req *gokvpb.GetRequest) (*gokvpb.GetResponse, error) {
+	bucket := callAuth(ctx).BucketID
+
+	entry, err := s.store.Get(ctx, bucket, req.Key)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, status.Error(codes.NotFound, "Key not found")
+		}
+		slog.ErrorContext(ctx, "Error getting key", "key", req.Key, "bucket", bucket, "error", err)
+		return nil, status.Error(codes.Internal, "Database error")
+	}
+
+	if s.trackAccess {
+		if err := s.store.RecordAccess(ctx, bucket, req.Key); err != nil {
+			slog.ErrorContext(ctx, "Error recording access", "key", req.Key, "bucket", bucket, "error", err)
+		}
+	}
+	return &gokvpb.GetResponse{Value: entry.Value, ContentType: entry.ContentType, Etag: etag(entry.Value)}, nil
+}
+
+func (s *grpcServer) Put(ctx context.Context, req *gokvpb.PutRequest) (*gokvpb.PutResponse, error) {
+	auth := callAuth(ctx)
+	if err := requireWritable(auth); err != nil {
+		return nil, err
+	}
+	if reason := s.keys.check(req.Key); reason != "" {
+		return nil, status.Error(codes.InvalidArgument, reason)
+	}
+	if int64(len(req.Value)) > s.maxValueBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "Value exceeds the maximum size of %d bytes", s.maxValueBytes)
+	}
+	if req.TtlSeconds < 0 || req.TtlSeconds > maxTTLSeconds {
+		return nil, status.Errorf(codes.InvalidArgument, "ttl_seconds must be between 0 and %d", maxTTLSeconds)
+	}
+
+	problems, err := s.schemas.validate(auth.BucketID, auth.Schema, req.Value)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error compiling schema", "bucket", auth.BucketID, "error", err)
+		return nil, status.Error(codes.Internal, "Failed to compile bucket schema")
+	}
+	if len(problems) > 0 {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Value does not match the bucket schema: %s", strings.Join(problems, "; ")))
+	}
+
+	entry := &Entry{Value: req.Value, ContentType: req.ContentType}
+	if req.TtlSeconds > 0 {
+		ttl, _ := ttlDuration(req.TtlSeconds)
+		entry.ExpiresAt = time.Now().Add(ttl)
+	}
+	_, err = s.store.Put(ctx, auth.BucketID, req.Key, entry, PutOptions{Limits: auth.Limits})
+	if err != nil {
+		if errors.Is(err, errQuotaExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, "Bucket storage quota exceeded")
+		}
+		if errors.Is(err, errKeyLimitExceeded) {
+			return nil, status.Error(codes.ResourceExhausted, "Bucket key limit reached")
+		}
+		if errors.Is(err, errBusy) {
+			return nil, status.Error(codes.Unavailable, "Database is busy, try again")
+		}
+		slog.ErrorContext(ctx, "Error putting key", "key", req.Key, "bucket", auth.BucketID, "error", err)
+		return nil, status.Error(codes.Internal, "Database error")
+	}
+	return &gokvpb.PutResponse{Etag: etag(req.Value)}, nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *gokvpb.DeleteRequest) (*gokvpb.DeleteResponse, error) {
+	auth := callAuth(ctx)
+	if err := requireWritable(auth); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.Delete(ctx, auth.BucketID, req.Key); err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, status.Error(codes.NotFound, "Key not found")
+		}
+		if errors.Is(err, errBusy) {
+			return nil, status.Error(codes.Unavailable, "Database is busy, try again")
+		}
+		slog.ErrorContext(ctx, "Error deleting key", "key", req.Key, "bucket", auth.BucketID, "error", err)
+		return nil, status.Error(codes.Internal, "Database error")
+	}
+	return &gokvpb.DeleteResponse{}, nil
+}
+
+func (s *grpcServer) List(ctx context.Context, req *gokvpb.ListRequest) (*gokvpb.ListResponse, error) {
+	bucket := callAuth(ctx).BucketID
+
+	limit := defaultListLimit
+	if req.Limit != 0 {
+		if req.Limit < 1 || req.Limit > maxListLimit {
+			return nil, status.Error(codes.InvalidArgument, "limit must be an integer between 1 and 1000")
+		}
+		limit = int(req.Limit)
+	}
+
+	// Fetch one extra key to learn whether there is another page
+	keys, err := s.store.List(ctx, bucket, ListOptions{Prefix: req.Prefix, After: req.After, Limit: limit + 1})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing keys", "bucket", bucket, "error", err)
+		return nil, status.Error(codes.Internal, "Database error")
+	}
+
+	resp := &gokvpb.ListResponse{Keys: keys}
+	if len(keys) > limit {
+		resp.Keys = keys[:limit]
+		resp.NextCursor = keys[limit-1]
+	}
+	return resp, nil
+}
+
+// Watch streams changes to a key until the client cancels, like watchHandler.
+// The stream ends when the client falls too far behind or the server shuts
+// down, and the client can call again.
+func (s *grpcServer) Watch(req *gokvpb.WatchRequest, stream grpc.ServerStreamingServer[gokvpb.WatchEvent]) error {
+	ctx := stream.Context()
+	sub := s.events.subscribe(callAuth(ctx).BucketID, req.Key)
+	defer s.events.unsubscribe(sub)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			msg := &gokvpb.WatchEvent{Type: gokvpb.WatchEvent_TYPE_DELETE, Key: req.Key}
+			if ev.Type == eventPut {
+				msg.Type = gokvpb.WatchEvent_TYPE_PUT
+				if !ev.NoValue {
+					msg.Value = ev.Value
+				}
+			}
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TestGRPCRateLimit checks that calls count towards a bucket's own rate limit,
+// as its HTTP requests do.
+func TestGRPCRateLimit(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, storeOptions{})
+	bucket, token, err := store.CreateBucket(ctx, "grpc@example.com", "", Limits{}, "")
+	if err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+	if err := store.SetRateLimit(ctx, bucket, 0.001); err != nil {
+		t.Fatalf("setting rate limit: %v", err)
+	}
+
+	s := &grpcServer{store: store, limiter: newRateLimiter(0, 1)}
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+token))
+	if _, err := s.authenticate(ctx); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	if _, err := s.authenticate(ctx); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second call: err = %v, want ResourceExhausted", err)
+	}
+
+	// Without a limit of its own or the server's, a bucket isn't limited
+	if err := store.SetRateLimit(ctx, bucket, 0); err != nil {
+		t.Fatalf("clearing rate limit: %v", err)
+	}
+	for range 3 {
+		if _, err := s.authenticate(ctx); err != nil {
+			t.Fatalf("unlimited call: %v", err)
+		}
+	}
+}
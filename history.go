@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// historyHandler lists the previous versions of a key, newest first. Each
+// overwrite of the key adds a version, up to -max-versions.
+func historyHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		versions, err := store.History(c.Request.Context(), bucket, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error listing versions", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, versions)
+	}
+}
+
+// revertHandler makes a previous version of a key its current value. The value
+// it replaces becomes a new version, so a revert can itself be undone.
+func revertHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+		if err != nil || version < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version must be a positive integer"})
+			return
+		}
+
+		entry, err := store.Revert(c.Request.Context(), bucket, key, version, bucketLimits(c))
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+				return
+			}
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error reverting key", "key", key, "bucket", bucket, "version", version, "error", err)
+			}
+			return
+		}
+
+		c.Header("ETag", etag(entry.Value))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// versionHandler returns a previous version of a key, like getHandler returns
+// its current value.
+func versionHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		version, err := strconv.ParseInt(c.Param("version"), 10, 64)
+		if err != nil || version < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version must be a positive integer"})
+			return
+		}
+
+		entry, err := store.GetVersion(c.Request.Context(), bucket, key, version)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error getting version", "key", key, "bucket", bucket, "version", version, "error", err)
+			return
+		}
+
+		c.Header("ETag", etag(entry.Value))
+		c.Data(http.StatusOK, valueContentType(entry.ContentType), entry.Value)
+	}
+}
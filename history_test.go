@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestHistorySkipsDeadValues checks that overwriting a live value records it
+// in the key's history, while writing over a trashed or expired value does
+// not.
+func TestHistorySkipsDeadValues(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, storeOptions{MaxVersions: 5})
+
+	put := func(key, value string, expiresAt time.Time) {
+		t.Helper()
+		entry := &Entry{Value: []byte(value), ExpiresAt: expiresAt}
+		if _, err := store.Put(ctx, "b", key, entry, PutOptions{}); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+	}
+
+	put("live", "old", time.Time{})
+	put("live", "new", time.Time{})
+
+	put("trashed", "old", time.Time{})
+	if err := store.Delete(ctx, "b", "trashed"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	put("trashed", "new", time.Time{})
+
+	put("expired", "old", time.Now().Add(-time.Second))
+	put("expired", "new", time.Time{})
+
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"live", 1},
+		{"trashed", 0},
+		{"expired", 0},
+	}
+	for _, tt := range tests {
+		versions, err := store.History(ctx, "b", tt.key)
+		if err != nil {
+			t.Fatalf("History %q: %v", tt.key, err)
+		}
+		if len(versions) != tt.want {
+			t.Errorf("History %q has %d versions, want %d", tt.key, len(versions), tt.want)
+		}
+	}
+}
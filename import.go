@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// importIsNDJSON reports whether an import body is newline-delimited JSON,
+// either by ?format=ndjson or its Content-Type.
+func importIsNDJSON(c *gin.Context) bool {
+	if format := c.Query("format"); format != "" {
+		return format == "ndjson"
+	}
+	return strings.HasPrefix(c.GetHeader("Content-Type"), "application/x-ndjson")
+}
+
+// errInvalidImport is returned by readImport for bodies in the wrong format.
+var errInvalidImport = errors.New("invalid import")
+
+// readImport decodes an import body in either of the formats produced by
+// exportHandler. Later occurrences of a key replace earlier ones.
+func readImport(r io.Reader, ndjson bool) (map[string]string, error) {
+	dec := json.NewDecoder(r)
+	if !ndjson {
+		var pairs map[string]string
+		if err := dec.Decode(&pairs); err != nil || pairs == nil {
+			return nil, errInvalidImport
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, errInvalidImport
+		}
+		return pairs, nil
+	}
+
+	pairs := map[string]string{}
+	for {
+		var rec exportRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil || rec.Key == "" {
+			return nil, errInvalidImport
+		}
+		pairs[rec.Key] = rec.Value
+	}
+}
+
+// importHandler writes the key-value pairs produced by exportHandler into the
+// bucket in a single transaction. With ?overwrite=false, keys that already
+// exist are skipped rather than replaced. Invalid key names and values larger
+// than maxValueBytes are rejected.
+func importHandler(store Store, keys keyValidator, schemas *schemaCache, maxValueBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+
+		overwrite := true
+		if v := c.Query("overwrite"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "overwrite must be true or false"})
+				return
+			}
+			overwrite = b
+		}
+
+		ndjson := importIsNDJSON(c)
+		pairs, err := readImport(c.Request.Body, ndjson)
+		if err != nil {
+			if ndjson {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be lines of {\"key\": ..., \"value\": ...} objects"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be a JSON object of string values"})
+			return
+		}
+
+		// Values arrive as JSON strings, so record them as text
+		entries := make(map[string]*Entry, len(pairs))
+		for key, value := range pairs {
+			if reason := keys.check(key); reason != "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": reason, "key": key})
+				return
+			}
+			if int64(len(value)) > maxValueBytes {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Value for key '%s' exceeds the maximum size of %d bytes", key, maxValueBytes)})
+				return
+			}
+			if !schemas.check(c, key, []byte(value)) {
+				return
+			}
+			entries[key] = &Entry{Value: []byte(value), ContentType: "text/plain; charset=utf-8"}
+		}
+
+		written, err := store.Import(c.Request.Context(), bucket, entries, overwrite, bucketLimits(c))
+		if err != nil {
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error importing keys", "bucket", bucket, "error", err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"imported": len(written), "skipped": len(entries) - len(written)})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// errDuplicateKey is returned when several keys of one batch are the same key
+// once normalized.
+var errDuplicateKey = errors.New("keys are the same once normalized")
+
+// keyNormalizer maps the names clients use to the keys entries are stored at,
+// so names differing only in case or Unicode form refer to the same entry.
+type keyNormalizer struct {
+	// foldCase lower-cases keys.
+	foldCase bool
+	// nfc puts keys in Unicode Normalization Form C, so e.g. a precomposed
+	// "é" and "e" followed by a combining accent are the same.
+	nfc bool
+}
+
+// normalize returns the key name is stored at.
+func (n keyNormalizer) normalize(name string) string {
+	if n.nfc {
+		name = norm.NFC.String(name)
+	}
+	if n.foldCase {
+		name = strings.ToLower(name)
+	}
+	return name
+}
+
+// normalizingStore wraps a Store to normalize every key before it is looked up
+// or written. The name an entry was last written under is kept alongside it,
+// and is what listings and exports show.
+type normalizingStore struct {
+	Store
+	keys keyNormalizer
+}
+
+// normalizeAll returns the keys names are stored at, and for each key the
+// names that map to it.
+func (s normalizingStore) normalizeAll(names []string) ([]string, map[string][]string) {
+	keys := make([]string, 0, len(names))
+	named := make(map[string][]string, len(names))
+	for _, name := range names {
+		key := s.keys.normalize(name)
+		if _, ok := named[key]; !ok {
+			keys = append(keys, key)
+		}
+		named[key] = append(named[key], name)
+	}
+	return keys, named
+}
+
+// normalizeEntries returns entries keyed by the keys they are stored at,
+// recording the names they were given. It fails with errDuplicateKey rather
+// than pick one of several entries for the same key.
+func (s normalizingStore) normalizeEntries(entries map[string]*Entry) (map[string]*Entry, map[string][]string, error) {
+	normalized := make(map[string]*Entry, len(entries))
+	named := make(map[string][]string, len(entries))
+	for name, entry := range entries {
+		key := s.keys.normalize(name)
+		if _, ok := normalized[key]; ok {
+			return nil, nil, errDuplicateKey
+		}
+		entry.Key = name
+		normalized[key] = entry
+		named[key] = []string{name}
+	}
+	return normalized, named, nil
+}
+
+// names maps keys back to the names they were asked for by.
+func names(keys []string, named map[string][]string) []string {
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, named[key]...)
+	}
+	return out
+}
+
+func (s normalizingStore) Get(ctx context.Context, bucket, key string) (*Entry, error) {
+	return s.Store.Get(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) GetRange(ctx context.Context, bucket, key string, resolve func(size int64) (offset, length int64, err error)) (*Entry, int64, error) {
+	return s.Store.GetRange(ctx, bucket, s.keys.normalize(key), resolve)
+}
+
+func (s normalizingStore) Open(ctx context.Context, bucket, key string) (*Entry, io.ReadCloser, error) {
+	return s.Store.Open(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) Stat(ctx context.Context, bucket, key string) (*Entry, error) {
+	return s.Store.Stat(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) RecordAccess(ctx context.Context, bucket, key string) error {
+	return s.Store.RecordAccess(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) Touch(ctx context.Context, bucket, key string, expiresAt time.Time) error {
+	return s.Store.Touch(ctx, bucket, s.keys.normalize(key), expiresAt)
+}
+
+func (s normalizingStore) SetMetadata(ctx context.Context, bucket, key, metadata string) error {
+	return s.Store.SetMetadata(ctx, bucket, s.keys.normalize(key), metadata)
+}
+
+func (s normalizingStore) Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (bool, error) {
+	entry.Key = key
+	return s.Store.Put(ctx, bucket, s.keys.normalize(key), entry, opts)
+}
+
+func (s normalizingStore) Delete(ctx context.Context, bucket, key string) error {
+	return s.Store.Delete(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) error {
+	return s.Store.DeleteIfMatch(ctx, bucket, s.keys.normalize(key), ifMatch)
+}
+
+func (s normalizingStore) Release(ctx context.Context, bucket, key, token string) error {
+	return s.Store.Release(ctx, bucket, s.keys.normalize(key), token)
+}
+
+func (s normalizingStore) DeletePrefix(ctx context.Context, bucket, prefix string) (int64, error) {
+	return s.Store.DeletePrefix(ctx, bucket, s.keys.normalize(prefix))
+}
+
+func (s normalizingStore) DeleteMany(ctx context.Context, bucket string, keys []string) ([]string, error) {
+	normalized, named := s.normalizeAll(keys)
+	deleted, err := s.Store.DeleteMany(ctx, bucket, normalized)
+	if err != nil {
+		return nil, err
+	}
+	return names(deleted, named), nil
+}
+
+func (s normalizingStore) Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (*Entry, error) {
+	return s.Store.Restore(ctx, bucket, s.keys.normalize(key), deletedSince, limits)
+}
+
+func (s normalizingStore) List(ctx context.Context, bucket string, opts ListOptions) ([]string, error) {
+	opts.Prefix = s.keys.normalize(opts.Prefix)
+	opts.After = s.keys.normalize(opts.After)
+	return s.Store.List(ctx, bucket, opts)
+}
+
+func (s normalizingStore) ListInfo(ctx context.Context, bucket string, opts ListOptions) ([]KeyInfo, error) {
+	opts.Prefix = s.keys.normalize(opts.Prefix)
+	opts.After = s.keys.normalize(opts.After)
+	return s.Store.ListInfo(ctx, bucket, opts)
+}
+
+func (s normalizingStore) Count(ctx context.Context, bucket, prefix string) (int64, error) {
+	return s.Store.Count(ctx, bucket, s.keys.normalize(prefix))
+}
+
+func (s normalizingStore) History(ctx context.Context, bucket, key string) ([]Version, error) {
+	return s.Store.History(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) GetVersion(ctx context.Context, bucket, key string, version int64) (*Entry, error) {
+	return s.Store.GetVersion(ctx, bucket, s.keys.normalize(key), version)
+}
+
+func (s normalizingStore) Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (*Entry, error) {
+	return s.Store.Revert(ctx, bucket, s.keys.normalize(key), version, limits)
+}
+
+func (s normalizingStore) Exists(ctx context.Context, bucket string, keys []string) (map[string]bool, error) {
+	normalized, named := s.normalizeAll(keys)
+	exists, err := s.Store.Exists(ctx, bucket, normalized)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool, len(keys))
+	for key, ok := range exists {
+		for _, name := range named[key] {
+			out[name] = ok
+		}
+	}
+	return out, nil
+}
+
+func (s normalizingStore) GetMany(ctx context.Context, bucket string, keys []string) (map[string][]byte, error) {
+	normalized, named := s.normalizeAll(keys)
+	values, err := s.Store.GetMany(ctx, bucket, normalized)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]byte, len(values))
+	for key, value := range values {
+		for _, name := range named[key] {
+			out[name] = value
+		}
+	}
+	return out, nil
+}
+
+func (s normalizingStore) PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) error {
+	normalized, _, err := s.normalizeEntries(entries)
+	if err != nil {
+		return err
+	}
+	return s.Store.PutMany(ctx, bucket, normalized, limits)
+}
+
+func (s normalizingStore) Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) ([]string, error) {
+	normalized, named, err := s.normalizeEntries(entries)
+	if err != nil {
+		return nil, err
+	}
+	written, err := s.Store.Import(ctx, bucket, normalized, overwrite, limits)
+	if err != nil {
+		return nil, err
+	}
+	return names(written, named), nil
+}
+
+func (s normalizingStore) Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (*Entry, error) {
+	return s.Store.Update(ctx, bucket, s.keys.normalize(key), limits, func(current *Entry) (*Entry, error) {
+		entry, err := fn(current)
+		if entry != nil {
+			entry.Key = key
+		}
+		return entry, err
+	})
+}
+
+// Incr increments through Update, so a counter is named like any other write.
+func (s normalizingStore) Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (int64, error) {
+	var value int64
+	_, err := s.Update(ctx, bucket, key, limits, increment(delta, &value))
+	return value, err
+}
+
+func (s normalizingStore) Push(ctx context.Context, bucket, key string, value []byte, limits Limits) (int64, error) {
+	return s.Store.Push(ctx, bucket, s.keys.normalize(key), value, limits)
+}
+
+func (s normalizingStore) Items(ctx context.Context, bucket, key string) ([][]byte, error) {
+	return s.Store.Items(ctx, bucket, s.keys.normalize(key))
+}
+
+func (s normalizingStore) Pop(ctx context.Context, bucket, key string) ([]byte, error) {
+	return s.Store.Pop(ctx, bucket, s.keys.normalize(key))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestKeyNormalizer(t *testing.T) {
+	tests := []struct {
+		keys keyNormalizer
+		name string
+		want string
+	}{
+		{keyNormalizer{}, "Café", "Café"},
+		{keyNormalizer{foldCase: true}, "Foo/BAR", "foo/bar"},
+		{keyNormalizer{foldCase: true}, "Café", "café"},
+		{keyNormalizer{nfc: true}, "Café", "Café"},
+		{keyNormalizer{nfc: true}, "Café", "Café"},
+		{keyNormalizer{foldCase: true, nfc: true}, "CAFÉ", "café"},
+	}
+	for _, tt := range tests {
+		if got := tt.keys.normalize(tt.name); got != tt.want {
+			t.Errorf("%+v.normalize(%q) = %q, want %q", tt.keys, tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestNormalizingStore checks that a key written under one name is read,
+// listed, fetched in batches and imported under another exactly when the two
+// normalize alike.
+func TestNormalizingStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		keys          keyNormalizer
+		written, read string
+		same          bool
+	}{
+		{"case folded", keyNormalizer{foldCase: true}, "Config", "cONFIG", true},
+		{"case kept", keyNormalizer{nfc: true}, "Config", "config", false},
+		{"composed", keyNormalizer{nfc: true}, "café", "café", true},
+		{"forms kept", keyNormalizer{foldCase: true}, "café", "café", false},
+		{"both", keyNormalizer{foldCase: true, nfc: true}, "CAFÉ", "café", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := normalizingStore{Store: newTestStore(t, storeOptions{}), keys: tt.keys}
+			if _, err := store.Put(ctx, "b", tt.written, &Entry{Value: []byte("v1")}, PutOptions{}); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			entry, err := store.Get(ctx, "b", tt.read)
+			switch {
+			case tt.same && err != nil:
+				t.Errorf("Get(%q): %v", tt.read, err)
+			case tt.same && string(entry.Value) != "v1":
+				t.Errorf("Get(%q) = %q, want %q", tt.read, entry.Value, "v1")
+			case !tt.same && !errors.Is(err, errNotFound):
+				t.Errorf("Get(%q): err = %v, want errNotFound", tt.read, err)
+			}
+
+			values, err := store.GetMany(ctx, "b", []string{tt.written, tt.read})
+			if err != nil {
+				t.Fatalf("GetMany: %v", err)
+			}
+			if _, ok := values[tt.read]; ok != tt.same {
+				t.Errorf("GetMany has %q = %v, want %v", tt.read, ok, tt.same)
+			}
+			if string(values[tt.written]) != "v1" {
+				t.Errorf("GetMany[%q] = %q, want %q", tt.written, values[tt.written], "v1")
+			}
+			exists, err := store.Exists(ctx, "b", []string{tt.read})
+			if err != nil {
+				t.Fatalf("Exists: %v", err)
+			}
+			if exists[tt.read] != tt.same {
+				t.Errorf("Exists[%q] = %v, want %v", tt.read, exists[tt.read], tt.same)
+			}
+
+			// Listings by a prefix in either spelling show the name the key
+			// was written under
+			keys, err := store.List(ctx, "b", ListOptions{Prefix: tt.read, Limit: 10})
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if want := []string{tt.written}; tt.same && !slices.Equal(keys, want) {
+				t.Errorf("List(prefix %q) = %q, want %q", tt.read, keys, want)
+			} else if !tt.same && len(keys) != 0 {
+				t.Errorf("List(prefix %q) = %q, want none", tt.read, keys)
+			}
+
+			// Importing under the other name replaces the key, and renames
+			// it, when the names normalize alike
+			written, err := store.Import(ctx, "b", map[string]*Entry{tt.read: {Value: []byte("v2")}}, true, Limits{})
+			if err != nil {
+				t.Fatalf("Import: %v", err)
+			}
+			if want := []string{tt.read}; !slices.Equal(written, want) {
+				t.Errorf("Import wrote %q, want %q", written, want)
+			}
+			keys, err = store.List(ctx, "b", ListOptions{Limit: 10})
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			want := []string{tt.read}
+			if !tt.same {
+				want = []string{tt.written, tt.read}
+				slices.Sort(want)
+			}
+			if slices.Sort(keys); !slices.Equal(keys, want) {
+				t.Errorf("List after Import = %q, want %q", keys, want)
+			}
+			entry, err = store.Get(ctx, "b", tt.written)
+			if err != nil {
+				t.Fatalf("Get(%q): %v", tt.written, err)
+			}
+			if want := map[bool]string{true: "v2", false: "v1"}[tt.same]; string(entry.Value) != want {
+				t.Errorf("Get(%q) after Import = %q, want %q", tt.written, entry.Value, want)
+			}
+		})
+	}
+}
+
+// TestDuplicateKeys checks that a batch naming one key twice, in spellings
+// that normalize alike, is refused rather than writing either.
+func TestDuplicateKeys(t *testing.T) {
+	ctx := context.Background()
+	store := normalizingStore{Store: newTestStore(t, storeOptions{}), keys: keyNormalizer{foldCase: true, nfc: true}}
+
+	tests := []struct {
+		name    string
+		entries map[string]*Entry
+		wantErr error
+	}{
+		{"case", map[string]*Entry{"Key": {Value: []byte("a")}, "KEY": {Value: []byte("b")}}, errDuplicateKey},
+		{"form", map[string]*Entry{"café": {Value: []byte("a")}, "café": {Value: []byte("b")}}, errDuplicateKey},
+		{"distinct", map[string]*Entry{"one": {Value: []byte("a")}, "two": {Value: []byte("b")}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := store.PutMany(ctx, "b", tt.entries, Limits{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("PutMany: err = %v, want %v", err, tt.wantErr)
+			}
+			if _, err := store.Import(ctx, "b", tt.entries, true, Limits{}); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Import: err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	keys, err := store.List(ctx, "b", ListOptions{Limit: 10})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"one", "two"}; !slices.Equal(keys, want) {
+		t.Errorf("List = %q, want %q", keys, want)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxKeyLength is the longest key name, in bytes, that may be written.
+const maxKeyLength = 512
+
+// keyValidator decides which key names may be written. Keys that already exist
+// can still be read and deleted whatever their names.
+type keyValidator struct {
+	// pattern, if set, must match the whole key. source is the pattern as
+	// given, for error messages.
+	pattern *regexp.Regexp
+	source  string
+}
+
+// newKeyValidator builds a validator. A non-empty pattern is anchored so that
+// it has to match the entire key.
+func newKeyValidator(pattern string) (keyValidator, error) {
+	if pattern == "" {
+		return keyValidator{}, nil
+	}
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return keyValidator{}, fmt.Errorf("invalid key pattern: %w", err)
+	}
+	return keyValidator{pattern: re, source: pattern}, nil
+}
+
+// check returns why key may not be written, or "" if it may.
+func (v keyValidator) check(key string) string {
+	switch {
+	case key == "":
+		return "Key must not be empty"
+	case len(key) > maxKeyLength:
+		return fmt.Sprintf("Key must be at most %d bytes", maxKeyLength)
+	case !utf8.ValidString(key):
+		return "Key must be valid UTF-8"
+	case strings.HasPrefix(key, "_"):
+		// Names like _count and _mget are taken by endpoints under /kv
+		return "Keys starting with _ are reserved"
+	case v.pattern != nil && !v.pattern.MatchString(key):
+		return fmt.Sprintf("Key must match the pattern %s", v.source)
+	}
+	return ""
+}
+
+// requireValidKey rejects writes to a :key whose name is not allowed.
+func requireValidKey(v keyValidator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if reason := v.check(c.Param("key")); reason != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": reason})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// pushHandler appends the request body to the end of the list at a key,
+// creating the list if needed, and returns the list's new length.
+func pushHandler(store Store, maxValueBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		value, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxValueBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Value exceeds the maximum size of %d bytes", maxValueBytes)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+			return
+		}
+
+		length, err := store.Push(c.Request.Context(), bucket, key, value, bucketLimits(c))
+		if err != nil {
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error pushing to list", "key", key, "bucket", bucket, "error", err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"length": length})
+	}
+}
+
+// itemsHandler returns the elements of the list at a key, first to last, as a
+// JSON array of strings. A list that doesn't exist is empty.
+func itemsHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		items, err := store.Items(c.Request.Context(), bucket, key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error reading list", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			values = append(values, string(item))
+		}
+		c.JSON(http.StatusOK, values)
+	}
+}
+
+// popHandler removes the last element of the list at a key and returns it as
+// the response body, or 404 if the list is empty.
+func popHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		value, err := store.Pop(c.Request.Context(), bucket, key)
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "List is empty"})
+				return
+			}
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error popping from list", "key", key, "bucket", bucket, "error", err)
+			}
+			return
+		}
+
+		c.Data(http.StatusOK, "application/octet-stream", value)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newListRouter returns a router serving the lists of one bucket of store with
+// limits, without authentication.
+func newListRouter(store Store, limits Limits) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/kv", func(c *gin.Context) {
+		c.Set("bucket", "test")
+		c.Set("limits", limits)
+		c.Next()
+	})
+	api.POST("/:key/push", pushHandler(store, 16))
+	api.GET("/:key/items", itemsHandler(store))
+	api.POST("/:key/pop", popHandler(store))
+	return router
+}
+
+func TestPushItemsPop(t *testing.T) {
+	router := newListRouter(newTestStore(t, storeOptions{}), Limits{})
+
+	if w := serve(router, http.MethodGet, "/kv/q/items", ""); w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("items of missing list = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, "[]")
+	}
+	for i, item := range []string{"one", "", "three"} {
+		w := serve(router, http.MethodPost, "/kv/q/push", item)
+		if want := fmt.Sprintf(`{"length":%d}`, i+1); w.Code != http.StatusOK || w.Body.String() != want {
+			t.Fatalf("push %q = %d %q, want %d %q", item, w.Code, w.Body.String(), http.StatusOK, want)
+		}
+	}
+	if w := serve(router, http.MethodGet, "/kv/q/items", ""); w.Body.String() != `["one","","three"]` {
+		t.Errorf("items = %q, want %q", w.Body.String(), `["one","","three"]`)
+	}
+
+	for _, want := range []string{"three", "", "one"} {
+		w := serve(router, http.MethodPost, "/kv/q/pop", "")
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("pop = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, want)
+		}
+	}
+	if w := serve(router, http.MethodPost, "/kv/q/pop", ""); w.Code != http.StatusNotFound {
+		t.Errorf("pop of empty list status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPushTooLarge(t *testing.T) {
+	router := newListRouter(newTestStore(t, storeOptions{}), Limits{})
+
+	if w := serve(router, http.MethodPost, "/kv/q/push", strings.Repeat("x", 17)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("push status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// TestPushKeyLimit checks that each list counts as a key towards the bucket's
+// key limit, alongside keys holding values.
+func TestPushKeyLimit(t *testing.T) {
+	store := newTestStore(t, storeOptions{})
+	limits := Limits{MaxKeys: 2}
+	router := newListRouter(store, limits)
+
+	if _, err := store.Put(context.Background(), "test", "value", &Entry{Value: []byte("v")}, PutOptions{Limits: limits}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if w := serve(router, http.MethodPost, "/kv/a/push", "x"); w.Code != http.StatusOK {
+		t.Fatalf("push to first list status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(router, http.MethodPost, "/kv/b/push", "x"); w.Code != http.StatusForbidden {
+		t.Errorf("push to new list over the limit status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	// Growing a list that exists doesn't create a key
+	if w := serve(router, http.MethodPost, "/kv/a/push", "y"); w.Code != http.StatusOK {
+		t.Errorf("push to existing list status = %d, want %d", w.Code, http.StatusOK)
+	}
+	// Nor can a value be written once lists have used up the limit
+	_, err := store.Put(context.Background(), "test", "other", &Entry{Value: []byte("v")}, PutOptions{Limits: limits})
+	if !errors.Is(err, errKeyLimitExceeded) {
+		t.Errorf("Put of new key: err = %v, want errKeyLimitExceeded", err)
+	}
+}
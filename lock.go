@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// defaultLockTTL is how long a lock is held when no X-TTL-Seconds is given.
+const defaultLockTTL = 30 * time.Second
+
+// lockContentType is the content type of lock keys, which tells them apart
+// from keys holding ordinary values.
+const lockContentType = "application/vnd.gokv.lock"
+
+// lockHandler acquires a lock by creating the key with a random lock token as
+// its value. The key expires after the lock's TTL, so a lock whose holder died
+// can be taken again. Returns 409 while the lock is held, or if the key holds
+// an ordinary value.
+func lockHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		ttl := defaultLockTTL
+		if v := c.GetHeader("X-TTL-Seconds"); v != "" {
+			var ok bool
+			if ttl, ok = parseTTL(v); !ok {
+				c.JSON(http.StatusBadRequest, gin.H{"error": invalidTTLMessage})
+				return
+			}
+		}
+
+		token := uuid.New().String()
+		entry := &Entry{
+			Value:       []byte(token),
+			ContentType: lockContentType,
+			ExpiresAt:   time.Now().Add(ttl),
+		}
+		_, err := store.Put(c.Request.Context(), bucket, key, entry, PutOptions{IfNoneMatch: true, Limits: bucketLimits(c)})
+		if errors.Is(err, errKeyExists) {
+			// A key that was released since is reported as held, as it
+			// was when the lock was asked for
+			current, err := store.Get(c.Request.Context(), bucket, key)
+			if err == nil && current.ContentType != lockContentType {
+				c.JSON(http.StatusConflict, gin.H{"error": "Key holds a value, not a lock"})
+				return
+			}
+			c.JSON(http.StatusConflict, gin.H{"error": "Lock is already held"})
+			return
+		}
+		if err != nil {
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error acquiring lock", "key", key, "bucket", bucket, "error", err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"token": token, "expires_at": entry.ExpiresAt.UTC().Format(time.RFC3339)})
+	}
+}
+
+// unlockRequest defines the structure for the /kv/:key/unlock endpoint request
+// body.
+type unlockRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// unlockHandler releases a lock given the token it was acquired with. The key
+// is removed for good rather than moved to the trash, so the lock can't be
+// restored with its old token. Returns 404 if the lock isn't held, e.g.
+// because it expired, and 409 if it is held under another token.
+func unlockHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		var req unlockRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Token is required"})
+			return
+		}
+
+		err := store.Release(c.Request.Context(), bucket, key, req.Token)
+		switch {
+		case errors.Is(err, errNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Lock not held"})
+			return
+		case errors.Is(err, errPreconditionFailed):
+			c.JSON(http.StatusConflict, gin.H{"error": "Lock is held under a different token"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error releasing lock", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
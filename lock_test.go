@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lock acquires the lock at key and returns its token.
+func lock(t *testing.T, router *gin.Engine, key string) string {
+	t.Helper()
+	w := serve(router, http.MethodPost, "/kv/"+key+"/lock", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("lock status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding lock: %v", err)
+	}
+	return resp.Token
+}
+
+// errorMessage returns the error reported in a response body.
+func errorMessage(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("decoding error %q: %v", body, err)
+	}
+	return resp.Error
+}
+
+func TestLockConflict(t *testing.T) {
+	router := newTestRouter(t)
+	lock(t, router, "job")
+
+	w := serve(router, http.MethodPost, "/kv/job/lock", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("second lock status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if got, want := errorMessage(t, w.Body.Bytes()), "Lock is already held"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+}
+
+func TestLockOverValue(t *testing.T) {
+	router := newTestRouter(t)
+	serve(router, http.MethodPost, "/kv/config", "data")
+
+	w := serve(router, http.MethodPost, "/kv/config/lock", "")
+	if w.Code != http.StatusConflict {
+		t.Fatalf("lock status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if got, want := errorMessage(t, w.Body.Bytes()), "Key holds a value, not a lock"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+	if w := serve(router, http.MethodGet, "/kv/config", ""); w.Body.String() != "data" {
+		t.Errorf("value after lock = %q, want %q", w.Body.String(), "data")
+	}
+}
+
+func TestUnlock(t *testing.T) {
+	router := newTestRouter(t)
+	token := lock(t, router, "job")
+
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{"token":"wrong"}`); w.Code != http.StatusConflict {
+		t.Errorf("unlock with wrong token status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{}`); w.Code != http.StatusBadRequest {
+		t.Errorf("unlock without token status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{"token":"`+token+`"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("unlock status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{"token":"`+token+`"}`); w.Code != http.StatusNotFound {
+		t.Errorf("second unlock status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRelockAfterExpiry(t *testing.T) {
+	store := newTestStore(t, storeOptions{})
+	router := testRouter(store)
+
+	// A lock whose holder died without releasing it
+	expired := &Entry{Value: []byte("old-token"), ContentType: lockContentType, ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err := store.Put(context.Background(), "test", "job", expired, PutOptions{}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	token := lock(t, router, "job")
+	if token == "old-token" {
+		t.Errorf("relock returned the expired lock's token")
+	}
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{"token":"old-token"}`); w.Code != http.StatusConflict {
+		t.Errorf("unlock with the expired token status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+// TestReleasedLockCannotBeRestored checks that unlocking doesn't leave the
+// lock in the trash, where restoring it would hand its token back out.
+func TestReleasedLockCannotBeRestored(t *testing.T) {
+	router := newTestRouter(t)
+
+	token := lock(t, router, "job")
+
+	if w := serve(router, http.MethodPost, "/kv/job/unlock", `{"token":"`+token+`"}`); w.Code != http.StatusNoContent {
+		t.Fatalf("unlock status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := serve(router, http.MethodPost, "/kv/job/restore", ""); w.Code != http.StatusNotFound {
+		t.Errorf("restore status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	lock(t, router, "job")
+}
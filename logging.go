@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// newLogger builds the process logger. format is "text" or "json" and level
+// is one of debug, info, warn or error.
+func newLogger(format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+// requestIDKey is the context key for the current request's ID.
+type requestIDKey struct{}
+
+// maxRequestIDLength bounds client-supplied request IDs.
+const maxRequestIDLength = 128
+
+// requestIDMiddleware tags each request with an ID, taken from the incoming
+// X-Request-ID header or generated if absent. The ID is echoed back in the
+// response and attached to every log line written for the request.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Next()
+	}
+}
+
+// validRequestID reports whether a client-supplied request ID is safe to echo
+// and log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r < 0x21 || r > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// contextHandler adds the request ID carried by a log call's context to the
+// record, so handlers only need to log with the request context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestLogger logs one line per request. It logs the route pattern rather
+// than the raw path and never logs headers or bodies, so tokens and values
+// stay out of the logs. Only a sampleRate fraction of successful reads is
+// logged, so a busy read path doesn't drown out everything else; writes and
+// requests that fail are always logged.
+func requestLogger(sampleRate float64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		status := c.Writer.Status()
+		read := c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead
+		success := status >= 200 && status < 300
+		if read && success && sampleRate < 1 && rand.Float64() >= sampleRate {
+			return
+		}
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+		}
+		if bucket := c.GetString("bucket"); bucket != "" {
+			attrs = append(attrs, "bucket", bucket)
+		}
+		if key := c.Param("key"); key != "" {
+			attrs = append(attrs, "key", key)
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(c.Request.Context(), level, "Request handled", attrs...)
+	}
+}
+
+// recoveryHandler logs a panic raised by a handler and responds with a 500.
+func recoveryHandler() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, err any) {
+		slog.ErrorContext(c.Request.Context(), "Panic handling request", "route", c.FullPath(), "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestStore returns a store backed by a fresh SQLite database.
+func newTestStore(t *testing.T, storeOpts storeOptions) Store {
+	t.Helper()
+	opts := sqliteOptions{JournalMode: "WAL", BusyTimeout: 5 * time.Second, Synchronous: "NORMAL"}
+	store, err := openSQLite(filepath.Join(t.TempDir(), "gokv.db"), opts, poolOptions{MaxOpenConns: 1}, storeOpts)
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// newTestRouter returns a router serving reads and writes of the keys of one
+// bucket from a fresh SQLite database, without authentication.
+func newTestRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	return testRouter(newTestStore(t, storeOptions{}))
+}
+
+// testRouter returns a router serving the keys of one bucket of store, without
+// authentication.
+func testRouter(store Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/kv", func(c *gin.Context) {
+		c.Set("bucket", "test")
+		c.Set("limits", Limits{})
+		c.Next()
+	})
+	api.GET("", listHandler(store))
+	api.GET("/:key", getHandler(store, false))
+	api.POST("/:key", putHandler(store, newSchemaCache(), 1<<20, 0, time.Hour))
+	api.POST("/:key/incr", incrHandler(store, newSchemaCache()))
+	api.POST("/:key/lock", lockHandler(store))
+	api.POST("/:key/unlock", unlockHandler(store))
+	api.POST("/:key/restore", restoreHandler(store, time.Hour))
+	return router
+}
+
+// serve makes a request to router and returns the response.
+func serve(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// TestValueRoundTrip checks that an empty value is told apart from a missing
+// key, and that values round-trip byte for byte.
+func TestValueRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"empty", ""},
+		{"whitespace", " \t\r\n "},
+		{"newline", "\n"},
+		{"text", "hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := newTestRouter(t)
+
+			w := serve(router, http.MethodPost, "/kv/k", tt.value)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("POST status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+			}
+
+			w = serve(router, http.MethodGet, "/kv/k", "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("GET status = %d, want %d; body %q", w.Code, http.StatusOK, w.Body.String())
+			}
+			if got := w.Body.String(); got != tt.value {
+				t.Errorf("GET body = %q, want %q", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	router := newTestRouter(t)
+
+	w := serve(router, http.MethodGet, "/kv/missing", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("GET status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// Writing an empty value to another key doesn't make this one exist
+	serve(router, http.MethodPost, "/kv/other", "")
+	if w := serve(router, http.MethodGet, "/kv/missing", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET status after writing another key = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestIncrBodyLimit(t *testing.T) {
+	router := newTestRouter(t)
+
+	body := `{"delta": 5` + strings.Repeat(" ", maxIncrBodyBytes) + `}`
+	if w := serve(router, http.MethodPost, "/kv/n/incr", body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("POST status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if w := serve(router, http.MethodPost, "/kv/n/incr", `{"delta": 5}`); w.Code != http.StatusOK || w.Body.String() != `{"value":5}` {
+		t.Errorf("POST = %d %q, want %d %q", w.Code, w.Body.String(), http.StatusOK, `{"value":5}`)
+	}
+}
+
+func TestListPagedBody(t *testing.T) {
+	router := newTestRouter(t)
+	for _, key := range []string{"a", "b", "c"} {
+		serve(router, http.MethodPost, "/kv/"+key, key)
+	}
+
+	var keys []string
+	after := ""
+	for range 3 {
+		w := serve(router, http.MethodGet, "/kv?paged=true&limit=2&after="+after, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET status = %d, want %d", w.Code, http.StatusOK)
+		}
+		var page struct {
+			Keys       []string `json:"keys"`
+			NextCursor *string  `json:"next_cursor"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("decoding page %q: %v", w.Body.String(), err)
+		}
+		keys = append(keys, page.Keys...)
+		if page.NextCursor == nil {
+			if h := w.Header().Get("X-Next-Cursor"); h != "" {
+				t.Errorf("X-Next-Cursor = %q on the last page", h)
+			}
+			break
+		}
+		if h := w.Header().Get("X-Next-Cursor"); h != *page.NextCursor {
+			t.Errorf("X-Next-Cursor = %q, want next_cursor %q", h, *page.NextCursor)
+		}
+		after = *page.NextCursor
+	}
+	if want := []string{"a", "b", "c"}; !slices.Equal(keys, want) {
+		t.Errorf("keys = %q, want %q", keys, want)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxMetadataBytes caps the size of the metadata attached to a key.
+const maxMetadataBytes = 8 << 10
+
+// errInvalidMetadata is returned by parseMetadata for metadata that is not
+// JSON.
+var errInvalidMetadata = errors.New("metadata is not valid JSON")
+
+// parseMetadata checks that raw is JSON and returns it compacted, so it fits
+// on one line of a response header. JSON null and empty input mean no
+// metadata.
+func parseMetadata(raw []byte) (string, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return "", errInvalidMetadata
+	}
+	if buf.String() == "null" {
+		return "", nil
+	}
+	return buf.String(), nil
+}
+
+// setMetadataHandler replaces the metadata of a key with the JSON in the
+// request body, without touching its value. A body of null removes it.
+func setMetadataHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxMetadataBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Metadata exceeds the maximum size of %d bytes", maxMetadataBytes)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+			return
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Metadata must be valid JSON"})
+			return
+		}
+		metadata, err := parseMetadata(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Metadata must be valid JSON"})
+			return
+		}
+
+		if err := store.SetMetadata(c.Request.Context(), bucket, key, metadata); err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error setting key metadata", "key", key, "bucket", bucket, "error", err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
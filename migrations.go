@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+)
+
+// migration is a step in the evolution of the schema, such as adding a column.
+// Migrations must be idempotent, since databases from before schema versions
+// were recorded may have had some of their changes applied already.
+type migration func(db *sql.DB) error
+
+// migrate applies the migrations db hasn't had yet, in order, and returns its
+// schema version, which is the number of migrations applied. The version is
+// recorded in the schema_version table after each migration, so one that
+// fails is retried on the next start. A database migrated by a newer build is
+// refused rather than risk writing to a schema this build doesn't know.
+func migrate(db *sql.DB, migrations []migration) (int, error) {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return 0, err
+	}
+
+	var current int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return 0, err
+	}
+	if current > len(migrations) {
+		return 0, fmt.Errorf("database schema version %d is newer than the %d this build supports", current, len(migrations))
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		if err := migrations[i](db); err != nil {
+			return 0, fmt.Errorf("migrating database schema to version %d: %w", version, err)
+		}
+		if _, err := db.Exec(fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", version)); err != nil {
+			return 0, fmt.Errorf("recording database schema version %d: %w", version, err)
+		}
+		slog.Info("Migrated database schema", "version", version)
+	}
+	return len(migrations), nil
+}
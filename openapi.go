@@ -0,0 +1,73 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec is the OpenAPI 3 description of the HTTP API. It is maintained
+// by hand next to the handlers; checkOpenAPI warns at startup about routes it
+// doesn't describe.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIDocument is the part of the spec read at startup.
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+// openAPIHandler serves the OpenAPI description, with its version set to the
+// running build. It needs no token.
+func openAPIHandler() gin.HandlerFunc {
+	spec := openAPISpec
+	var doc map[string]any
+	if err := json.Unmarshal(openAPISpec, &doc); err == nil {
+		if info, ok := doc["info"].(map[string]any); ok {
+			info["version"] = currentBuild().Version
+		}
+		if b, err := json.Marshal(doc); err == nil {
+			spec = b
+		}
+	}
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/json", spec)
+	}
+}
+
+// checkOpenAPI logs a warning for every route the OpenAPI description is
+// missing, so the spec doesn't silently fall behind the handlers. Preflight
+// routes aren't part of the API and are skipped.
+func checkOpenAPI(routes gin.RoutesInfo) {
+	var doc openAPIDocument
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		slog.Warn("Invalid OpenAPI description", "error", err)
+		return
+	}
+	for _, route := range routes {
+		if route.Method == http.MethodOptions {
+			continue
+		}
+		path := openAPIPath(route.Path)
+		if _, ok := doc.Paths[path][strings.ToLower(route.Method)]; !ok {
+			slog.Warn("Route missing from the OpenAPI description", "method", route.Method, "path", path)
+		}
+	}
+}
+
+// openAPIPath converts a gin route path such as /kv/:key to the OpenAPI
+// form /kv/{key}.
+func openAPIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
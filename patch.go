@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Errors returned by the update functions of read-modify-write handlers.
+var (
+	errNotJSON       = errors.New("value is not valid JSON")
+	errValueTooLarge = errors.New("value too large")
+)
+
+// patchHandler applies an RFC 7386 JSON Merge Patch from the request body to
+// the JSON document stored at a key and returns the patched document. The read
+// and write share a transaction, so concurrent patches don't lose updates. The
+// patched document must match the bucket's schema, if it has one.
+func patchHandler(store Store, schemas *schemaCache, maxValueBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxValueBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Patch exceeds the maximum size of %d bytes", maxValueBytes)})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read request body"})
+			return
+		}
+		patch, err := decodeJSON(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Patch must be valid JSON"})
+			return
+		}
+
+		entry, err := store.Update(c.Request.Context(), bucket, key, bucketLimits(c), func(current *Entry) (*Entry, error) {
+			if current == nil {
+				return nil, errNotFound
+			}
+			doc, err := decodeJSON(current.Value)
+			if err != nil {
+				return nil, errNotJSON
+			}
+
+			value, err := encodeJSON(mergePatch(doc, patch))
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(value)) > maxValueBytes {
+				return nil, errValueTooLarge
+			}
+			if err := schemas.conform(c, value); err != nil {
+				return nil, err
+			}
+			current.Value = value
+			return current, nil
+		})
+		if err != nil {
+			switch {
+			case writeSchemaError(c, key, err):
+			case errors.Is(err, errNotFound):
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+			case errors.Is(err, errNotJSON):
+				c.JSON(http.StatusConflict, gin.H{"error": "Existing value is not valid JSON"})
+			case errors.Is(err, errValueTooLarge):
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Patched value exceeds the maximum size of %d bytes", maxValueBytes)})
+			default:
+				if !writeStoreError(c, err) {
+					slog.ErrorContext(c.Request.Context(), "Error patching key", "key", key, "bucket", bucket, "error", err)
+				}
+			}
+			return
+		}
+
+		c.Header("ETag", etag(entry.Value))
+		c.Data(http.StatusOK, valueContentType(entry.ContentType), entry.Value)
+	}
+}
+
+// decodeJSON parses a single JSON document, keeping numbers exact.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errNotJSON
+	}
+	return v, nil
+}
+
+// encodeJSON serializes v without the HTML escaping and trailing newline
+// json.Encoder adds by default.
+func encodeJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// mergePatch applies patch to target as described in RFC 7386: objects are
+// merged recursively, null removes a member and anything else replaces the
+// target outright.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+		t[name] = mergePatch(t[name], value)
+	}
+	return t
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // PostgreSQL driver for database/sql
+)
+
+// postgresDialect describes PostgreSQL to sqlStore.
+var postgresDialect = dialect{
+	numberedParams: true,
+	sizeExpr:       "octet_length(value)",
+	substrExpr:     "substr(value, CAST(? AS INTEGER), CAST(? AS INTEGER))",
+	sizeQuery:      "SELECT pg_database_size(current_database())",
+	// Read-modify-write transactions must not interleave with each other, which
+	// SQLite guarantees by locking the whole database for writes
+	txOptions:         &sql.TxOptions{Isolation: sql.LevelSerializable},
+	isUniqueViolation: func(err error) bool { return hasPgCode(err, "23505") },
+	isRetryable:       func(err error) bool { return hasPgCode(err, "40001") },
+	hasColumn:         pgHasColumn,
+}
+
+// pgHasColumn reports whether table in the current schema has a column with
+// the given name.
+func pgHasColumn(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// hasPgCode reports whether err is a PostgreSQL error with the given SQLSTATE.
+func hasPgCode(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+// openPostgres connects to the PostgreSQL database at dsn as a Store, creating
+// the tables if needed.
+func openPostgres(dsn string, pool poolOptions, storeOpts storeOptions) (Store, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	pool.apply(db)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS buckets (
+			bucket_id TEXT PRIMARY KEY,
+			email TEXT NOT NULL UNIQUE,
+			max_bytes BIGINT
+		)`,
+		`CREATE TABLE IF NOT EXISTS tokens (
+			token_hash TEXT PRIMARY KEY,
+			bucket_id TEXT NOT NULL REFERENCES buckets (bucket_id),
+			scope TEXT NOT NULL DEFAULT 'rw',
+			created_at BIGINT
+		)`,
+		`CREATE TABLE IF NOT EXISTS kv_store (
+			bucket TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value BYTEA,
+			content_type TEXT,
+			expires_at BIGINT,
+			created_at BIGINT,
+			updated_at BIGINT,
+			deleted_at BIGINT,
+			value_size BIGINT,
+			value_flags INTEGER NOT NULL DEFAULT 0,
+			write_ts BIGINT,
+			access_count BIGINT NOT NULL DEFAULT 0,
+			last_accessed_at BIGINT,
+			metadata TEXT,
+			key_norm TEXT,
+			PRIMARY KEY (bucket, key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS kv_history (
+			bucket TEXT NOT NULL,
+			key TEXT NOT NULL,
+			version BIGINT NOT NULL,
+			value BYTEA,
+			value_size BIGINT NOT NULL,
+			value_flags INTEGER NOT NULL DEFAULT 0,
+			content_type TEXT,
+			metadata TEXT,
+			updated_at BIGINT,
+			replaced_at BIGINT NOT NULL,
+			PRIMARY KEY (bucket, key, version)
+		)`,
+		`CREATE TABLE IF NOT EXISTS kv_lists (
+			bucket TEXT NOT NULL,
+			key TEXT NOT NULL,
+			idx BIGINT NOT NULL,
+			value BYTEA,
+			value_size BIGINT NOT NULL,
+			value_flags INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (bucket, key, idx)
+		)`,
+		`CREATE TABLE IF NOT EXISTS idempotency_keys (
+			bucket TEXT NOT NULL,
+			idem_key TEXT NOT NULL,
+			fingerprint TEXT NOT NULL,
+			status INTEGER NOT NULL,
+			created_at BIGINT NOT NULL,
+			PRIMARY KEY (bucket, idem_key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id BIGSERIAL PRIMARY KEY,
+			bucket TEXT NOT NULL,
+			key TEXT NOT NULL,
+			operation TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			created_at BIGINT NOT NULL
+		)`,
+		"CREATE INDEX IF NOT EXISTS audit_log_bucket ON audit_log (bucket, id)",
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	schemaVersion, err := migrate(db, postgresMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := newSQLStore(db, postgresDialect, storeOpts)
+	store.schemaVersion = schemaVersion
+	if err := store.migrateTokenHashes(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	slog.Info("Database initialized", "driver", "postgres", "schema_version", schemaVersion)
+	return store, nil
+}
+
+// postgresMigrations bring the tables created by openPostgres up to date, in
+// order. Add new migrations to the end and never change released ones.
+var postgresMigrations = []migration{
+	// Columns added before schema versions were recorded
+	func(db *sql.DB) error {
+		statements := []string{
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS webhook_url TEXT",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS webhook_secret TEXT",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS verify_code_hash TEXT",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS json_schema TEXT",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS frozen BOOLEAN NOT NULL DEFAULT FALSE",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS rate_limit DOUBLE PRECISION",
+			"ALTER TABLE buckets ADD COLUMN IF NOT EXISTS max_keys BIGINT",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS deleted_at BIGINT",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS value_size BIGINT",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS value_flags INTEGER NOT NULL DEFAULT 0",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS write_ts BIGINT",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS access_count BIGINT NOT NULL DEFAULT 0",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS last_accessed_at BIGINT",
+			"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS metadata TEXT",
+			"ALTER TABLE kv_history ADD COLUMN IF NOT EXISTS metadata TEXT",
+		}
+		for _, stmt := range statements {
+			if _, err := db.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// Keys looked up by key_norm, with the name they were written under in key
+	func(db *sql.DB) error {
+		statements := []string{"ALTER TABLE kv_store ADD COLUMN IF NOT EXISTS key_norm TEXT"}
+		hasOriginal, err := pgHasColumn(db, "kv_store", "original_key")
+		if err != nil {
+			return err
+		}
+		if hasOriginal {
+			statements = append(statements,
+				"UPDATE kv_store SET key_norm = key, key = COALESCE(original_key, key)",
+				"ALTER TABLE kv_store DROP COLUMN original_key",
+			)
+		}
+		statements = append(statements,
+			"UPDATE kv_store SET key_norm = key WHERE key_norm IS NULL",
+			"CREATE UNIQUE INDEX IF NOT EXISTS kv_store_key_norm ON kv_store (bucket, key_norm)",
+		)
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	},
+}
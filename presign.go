@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Presigned URLs are valid for defaultPresignTTL unless X-TTL-Seconds asks for
+// another duration of up to maxPresignTTL.
+const (
+	defaultPresignTTL = time.Hour
+	maxPresignTTL     = 7 * 24 * time.Hour
+)
+
+// minSigningKeyBytes is the shortest -signing-key accepted.
+const minSigningKeyBytes = 16
+
+// urlSigner signs and checks the URLs that grant read access to a single key
+// without a token.
+type urlSigner struct {
+	key []byte
+}
+
+// newURLSigner returns a signer for secret, or an error if it is too short to
+// be safe.
+func newURLSigner(secret string) (urlSigner, error) {
+	if len(secret) < minSigningKeyBytes {
+		return urlSigner{}, fmt.Errorf("signing key must be at least %d bytes", minSigningKeyBytes)
+	}
+	return urlSigner{key: []byte(secret)}, nil
+}
+
+// sign returns the signature of a URL for key in bucket that expires at
+// expires, in Unix seconds.
+func (s urlSigner) sign(bucket, key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(bucket + "\x00" + key + "\x00" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sharedLocation returns the path and query of a signed URL for key.
+func (s urlSigner) sharedLocation(bucket, key string, expires int64) string {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", s.sign(bucket, key, expires))
+	return "/shared/" + url.PathEscape(bucket) + "/" + url.PathEscape(key) + "?" + query.Encode()
+}
+
+// presignHandler mints a URL that anyone can use to read a key until it
+// expires, without a token. The URL is signed with the server's signing key,
+// so it can't be altered to read another key or to last longer.
+func presignHandler(signer urlSigner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		ttl := defaultPresignTTL
+		if v := c.GetHeader("X-TTL-Seconds"); v != "" {
+			var ok bool
+			if ttl, ok = parseTTL(v); !ok || ttl > maxPresignTTL {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("X-TTL-Seconds must be a positive integer of at most %d", int64(maxPresignTTL/time.Second))})
+				return
+			}
+		}
+
+		expires := time.Now().Add(ttl).Unix()
+		c.JSON(http.StatusCreated, gin.H{
+			"url":        signer.sharedLocation(bucket, key, expires),
+			"expires_at": time.Unix(expires, 0).UTC().Format(time.RFC3339),
+		})
+	}
+}
+
+// requireSignature admits requests for a /shared URL whose signature matches
+// and that hasn't expired, in place of a token. The bucket is taken from the
+// URL, so the handlers that follow can serve it like an authenticated read.
+func requireSignature(signer urlSigner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.Param("bucket")
+		key := c.Param("key")
+
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		signature := c.Query("signature")
+		if err != nil || signature == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "URL is not signed"})
+			c.Abort()
+			return
+		}
+		if !hmac.Equal([]byte(signature), []byte(signer.sign(bucket, key, expires))) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid signature"})
+			c.Abort()
+			return
+		}
+		if time.Now().Unix() >= expires {
+			c.JSON(http.StatusForbidden, gin.H{"error": "URL has expired"})
+			c.Abort()
+			return
+		}
+
+		c.Set("bucket", bucket)
+		c.Next()
+	}
+}
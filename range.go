@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errRangeNotSatisfiable is returned when a requested range lies outside the
+// value.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a single range from a Range header. With suffix set, it is the
+// last n bytes; otherwise it runs from start to end inclusive, with an end of
+// -1 meaning the end of the value.
+type byteRange struct {
+	start, end int64
+	suffix     bool
+	n          int64
+}
+
+// parseRange parses a Range header asking for a single byte range. Headers it
+// doesn't understand, including those with several ranges, are reported as not
+// ok so the whole value is served instead, as HTTP allows.
+func parseRange(header string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, false
+		}
+		return byteRange{suffix: true, n: n}, true
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	end := int64(-1)
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false
+		}
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the offset and length of the range within a value of size
+// bytes, or errRangeNotSatisfiable if none of it lies within the value.
+func (r byteRange) resolve(size int64) (int64, int64, error) {
+	if r.suffix {
+		n := min(r.n, size)
+		if n == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return size - n, n, nil
+	}
+
+	if r.start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	end := size - 1
+	if r.end >= 0 && r.end < end {
+		end = r.end
+	}
+	return r.start, end - r.start + 1, nil
+}
+
+// serveRange answers a GET with a Range header with 206 Partial Content and
+// just the requested bytes, which are all that is read from the database. A
+// range outside the value gets 416.
+func serveRange(c *gin.Context, store Store, bucket, key string, r byteRange) {
+	var size int64
+	entry, offset, err := store.GetRange(c.Request.Context(), bucket, key, func(s int64) (int64, int64, error) {
+		size = s
+		return r.resolve(s)
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		case errors.Is(err, errRangeNotSatisfiable):
+			c.Header("Content-Range", fmt.Sprintf("bytes */%d", size))
+			c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{"error": "Range not satisfiable"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			slog.ErrorContext(c.Request.Context(), "Error getting key range", "key", key, "bucket", bucket, "error", err)
+		}
+		return
+	}
+
+	setEntryHeaders(c, entry)
+	c.Header("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(entry.Value))-1, entry.Size))
+	c.Data(http.StatusPartialContent, valueContentType(entry.ContentType), entry.Value)
+}
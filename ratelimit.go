@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterIdleTimeout is how long a bucket's limiter is kept after its last
+// request. A bucket that has been idle this long has a full burst again anyway.
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// rateLimiter hands out a token-bucket limiter per bucket ID.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*bucketLimiter
+}
+
+// bucketLimiter is a single bucket's limiter and when it was last used.
+type bucketLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter allows each bucket rps requests per second on average, with
+// bursts of up to burst requests. A zero rps leaves buckets unlimited unless
+// they have a limit of their own. Idle limiters are only dropped while cleanup
+// runs.
+func newRateLimiter(rps float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:    rate.Limit(rps),
+		burst:    burst,
+		limiters: map[string]*bucketLimiter{},
+	}
+}
+
+// get returns the limiter for a bucket, creating it on first use. A non-zero
+// rps is the bucket's own limit, which replaces the default one; a limiter
+// whose limit has changed since it was created is updated.
+func (rl *rateLimiter) get(bucket string, rps float64) *rate.Limiter {
+	limit := rl.limit
+	if rps > 0 {
+		limit = rate.Limit(rps)
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	bl, ok := rl.limiters[bucket]
+	if !ok {
+		bl = &bucketLimiter{limiter: rate.NewLimiter(limit, rl.burst)}
+		rl.limiters[bucket] = bl
+	} else if bl.limiter.Limit() != limit {
+		bl.limiter.SetLimit(limit)
+	}
+	bl.lastSeen = time.Now()
+	return bl.limiter
+}
+
+// cleanup drops the limiters of buckets that have gone idle every minute, so
+// the map doesn't grow with every bucket ever seen, until ctx is cancelled.
+func (rl *rateLimiter) cleanup(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rl.mu.Lock()
+		for bucket, bl := range rl.limiters {
+			if time.Since(bl.lastSeen) > rateLimiterIdleTimeout {
+				delete(rl.limiters, bucket)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// allow takes a token for a request from bucket, whose own limit is rps, and
+// reports whether it may go ahead. If not, it returns how long until it
+// would, in whole seconds.
+func (rl *rateLimiter) allow(bucket string, rps float64) (retryAfter int, ok bool) {
+	if rps <= 0 && rl.limit <= 0 {
+		// Neither the server nor the bucket sets a limit
+		return 0, true
+	}
+	r := rl.get(bucket, rps).Reserve()
+	if delay := r.Delay(); delay > 0 {
+		// Don't let the rejected request use up a future token
+		r.Cancel()
+		return int(math.Ceil(delay.Seconds())), false
+	}
+	return 0, true
+}
+
+// rateLimitMiddleware rejects requests from buckets that have exceeded their
+// rate with 429 and a Retry-After header. It must run after authMiddleware.
+func rateLimitMiddleware(rl *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if retryAfter, ok := rl.allow(c.GetString("bucket"), c.GetFloat64("rate_limit")); !ok {
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// maxSchemaBytes caps the size of a bucket's JSON Schema.
+const maxSchemaBytes = 64 << 10
+
+// schemaURL names a bucket's schema while it is compiled. It is not fetched.
+const schemaURL = "mem:///bucket.json"
+
+// compileSchema compiles a JSON Schema. References to other documents are
+// refused, so a schema can't make the server read files or fetch URLs.
+func compileSchema(source string) (*jsonschema.Schema, error) {
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(source))
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.UseLoader(jsonschema.SchemeURLLoader{})
+	compiler.DefaultDraft(jsonschema.Draft2020)
+	if err := compiler.AddResource(schemaURL, doc); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(schemaURL)
+}
+
+// schemaCache holds the compiled schema of each bucket, so a schema is only
+// compiled again when it changes.
+type schemaCache struct {
+	mu      sync.Mutex
+	schemas map[string]cachedSchema
+}
+
+// cachedSchema is a compiled schema along with the source it was compiled from.
+type cachedSchema struct {
+	source string
+	schema *jsonschema.Schema
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{schemas: map[string]cachedSchema{}}
+}
+
+// get returns the compiled form of a bucket's schema source.
+func (sc *schemaCache) get(bucket, source string) (*jsonschema.Schema, error) {
+	sc.mu.Lock()
+	cached, ok := sc.schemas[bucket]
+	sc.mu.Unlock()
+	if ok && cached.source == source {
+		return cached.schema, nil
+	}
+
+	schema, err := compileSchema(source)
+	if err != nil {
+		return nil, err
+	}
+	sc.mu.Lock()
+	sc.schemas[bucket] = cachedSchema{source: source, schema: schema}
+	sc.mu.Unlock()
+	return schema, nil
+}
+
+// check validates a value about to be written to key against the bucket's
+// schema, if it has one. It writes a 422 response listing the problems and
+// returns false if the value doesn't conform.
+func (sc *schemaCache) check(c *gin.Context, key string, value []byte) bool {
+	bucket := c.GetString("bucket")
+	problems, err := sc.validate(bucket, c.GetString("schema"), value)
+	if err != nil {
+		// The schema was checked when it was set, so this shouldn't happen
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compile bucket schema"})
+		slog.ErrorContext(c.Request.Context(), "Error compiling schema", "bucket", bucket, "error", err)
+		return false
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Value does not match the bucket schema", "key": key, "details": problems})
+		return false
+	}
+	return true
+}
+
+// schemaMismatchError is returned by the update function of a read-modify-write
+// handler whose result doesn't match the bucket's schema.
+type schemaMismatchError struct {
+	problems []string
+}
+
+func (e *schemaMismatchError) Error() string {
+	return "value does not match the bucket schema"
+}
+
+// conform is like check for the result of an update, which is only known
+// inside the store's transaction: rather than writing a response, it returns a
+// *schemaMismatchError for writeSchemaError to answer after the update fails.
+func (sc *schemaCache) conform(c *gin.Context, value []byte) error {
+	problems, err := sc.validate(c.GetString("bucket"), c.GetString("schema"), value)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return &schemaMismatchError{problems: problems}
+	}
+	return nil
+}
+
+// writeSchemaError writes the 422 response for a *schemaMismatchError, like
+// check does, and reports whether err was one.
+func writeSchemaError(c *gin.Context, key string, err error) bool {
+	var mismatch *schemaMismatchError
+	if !errors.As(err, &mismatch) {
+		return false
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Value does not match the bucket schema", "key": key, "details": mismatch.problems})
+	return true
+}
+
+// validate returns what is wrong with a value according to the bucket's schema
+// source, or nil if it conforms or the bucket has no schema.
+func (sc *schemaCache) validate(bucket, source string, value []byte) ([]string, error) {
+	if source == "" {
+		return nil, nil
+	}
+	schema, err := sc.get(bucket, source)
+	if err != nil {
+		return nil, err
+	}
+	return validateValue(schema, value), nil
+}
+
+// validateValue returns what is wrong with value according to schema, one
+// message per problem, or nil if it conforms.
+func validateValue(schema *jsonschema.Schema, value []byte) []string {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(value))
+	if err != nil {
+		return []string{"Value is not valid JSON"}
+	}
+
+	err = schema.Validate(doc)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil
+	}
+	var problems []string
+	collectProblems(validationErr, &problems)
+	if len(problems) == 0 {
+		problems = []string{validationErr.Error()}
+	}
+	return problems
+}
+
+// collectProblems appends the messages of the innermost causes of err, which
+// name the actual problems; outer errors only say that a keyword such as
+// $ref or allOf failed.
+func collectProblems(err *jsonschema.ValidationError, problems *[]string) {
+	if len(err.Causes) > 0 {
+		for _, cause := range err.Causes {
+			collectProblems(cause, problems)
+		}
+		return
+	}
+	unit := err.BasicOutput()
+	if unit.Error == nil {
+		return
+	}
+	location := unit.InstanceLocation
+	if location == "" {
+		location = "/"
+	}
+	*problems = append(*problems, fmt.Sprintf("%s: %s", location, unit.Error))
+}
+
+// setSchemaHandler sets the JSON Schema that values written to the bucket
+// must match. The request body is the schema itself.
+func setSchemaHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSchemaBytes))
+		if err != nil {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Schema exceeds the maximum size of %d bytes", maxSchemaBytes)})
+			return
+		}
+		if _, err := compileSchema(string(body)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON Schema", "details": err.Error()})
+			return
+		}
+
+		if err := store.SetSchema(c.Request.Context(), bucket, string(body)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set schema"})
+			slog.ErrorContext(c.Request.Context(), "Error setting schema", "bucket", bucket, "error", err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// getSchemaHandler returns the bucket's JSON Schema, or 404 if it has none.
+func getSchemaHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		source := c.GetString("schema")
+		if source == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Bucket has no schema"})
+			return
+		}
+		c.Data(http.StatusOK, "application/schema+json", []byte(source))
+	}
+}
+
+// deleteSchemaHandler removes the bucket's schema, so any value may be written
+// again.
+func deleteSchemaHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+
+		if err := store.SetSchema(c.Request.Context(), bucket, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schema"})
+			slog.ErrorContext(c.Request.Context(), "Error deleting schema", "bucket", bucket, "error", err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
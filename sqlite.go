@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite" // Pure Go SQLite driver
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteDialect describes SQLite to sqlStore.
+var sqliteDialect = dialect{
+	sizeExpr:   "length(CAST(value AS BLOB))",
+	substrExpr: "substr(CAST(value AS BLOB), ?, ?)",
+	// The main database file holds exactly this many bytes
+	sizeQuery: "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()",
+	isUniqueViolation: func(err error) bool {
+		// Use strings.Contains for broad compatibility with SQLite error messages
+		return strings.Contains(err.Error(), "UNIQUE constraint failed")
+	},
+	isRetryable: isBusy,
+	hasColumn:   hasColumn,
+	backup:      sqliteBackup,
+}
+
+// isBusy reports whether err is SQLite's "database is locked", returned when
+// busy_timeout passes without getting a lock, or its snapshot variant, which
+// is returned at once when a read transaction can't be upgraded to a write.
+func isBusy(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// sqliteBackup copies the database with VACUUM INTO, which reads it in a
+// single transaction so the copy is consistent without blocking writers, then
+// streams the copy to w.
+func sqliteBackup(ctx context.Context, db *sql.DB, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "gokv-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "backup.db")
+	if _, err := db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// poolOptions holds the database connection pool limits.
+type poolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// apply sets the pool limits on db.
+func (o poolOptions) apply(db *sql.DB) {
+	db.SetMaxOpenConns(o.MaxOpenConns)
+	db.SetMaxIdleConns(o.MaxIdleConns)
+	db.SetConnMaxLifetime(o.ConnMaxLifetime)
+}
+
+// sqliteOptions holds the pragmas applied to every SQLite connection.
+type sqliteOptions struct {
+	JournalMode string
+	BusyTimeout time.Duration
+	Synchronous string
+}
+
+// dsn builds the data source name for dbFile. Pragmas are passed in the DSN
+// rather than executed once because busy_timeout, synchronous and
+// case_sensitive_like are per connection, and database/sql may open several.
+// LIKE is made case-sensitive so prefix matches agree with Postgres and with
+// the bucket's key normalization.
+func (o sqliteOptions) dsn(dbFile string) (string, error) {
+	journalMode := strings.ToUpper(o.JournalMode)
+	switch journalMode {
+	case "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return "", fmt.Errorf("invalid journal mode %q", o.JournalMode)
+	}
+	synchronous := strings.ToUpper(o.Synchronous)
+	switch synchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return "", fmt.Errorf("invalid synchronous mode %q", o.Synchronous)
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", journalMode))
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.BusyTimeout.Milliseconds()))
+	params.Add("_pragma", fmt.Sprintf("synchronous(%s)", synchronous))
+	params.Add("_pragma", "case_sensitive_like(1)")
+	return dbFile + "?" + params.Encode(), nil
+}
+
+// openSQLite opens the SQLite database at dbFile as a Store.
+func openSQLite(dbFile string, opts sqliteOptions, pool poolOptions, storeOpts storeOptions) (Store, error) {
+	db, schemaVersion, err := setupDatabase(dbFile, opts, pool)
+	if err != nil {
+		return nil, err
+	}
+	store := newSQLStore(db, sqliteDialect, storeOpts)
+	store.schemaVersion = schemaVersion
+	if err := store.migrateTokenHashes(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// setupDatabase initializes the SQLite database and creates the necessary table.
+func setupDatabase(dbFile string, opts sqliteOptions, pool poolOptions) (*sql.DB, int, error) {
+	dsn, err := opts.dsn(dbFile)
+	if err != nil {
+		return nil, 0, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, 0, err
+	}
+	pool.apply(db)
+
+	// SQLite silently keeps the old journal mode if it can't switch, e.g. for
+	// in-memory databases, so check the mode actually took effect
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		return nil, 0, err
+	}
+	if !strings.EqualFold(journalMode, opts.JournalMode) {
+		return nil, 0, fmt.Errorf("journal mode is %s, expected %s", journalMode, opts.JournalMode)
+	}
+
+	// SQL statements to create tables
+	createKVSQL := `CREATE TABLE IF NOT EXISTS kv_store (
+        "bucket" TEXT NOT NULL,
+        "key" TEXT NOT NULL,
+        "value" BLOB,
+        "content_type" TEXT,
+        "expires_at" INTEGER,
+        "created_at" INTEGER,
+        "updated_at" INTEGER,
+        "deleted_at" INTEGER,
+        "value_size" INTEGER,
+        "value_flags" INTEGER NOT NULL DEFAULT 0,
+        "write_ts" INTEGER,
+        "access_count" INTEGER NOT NULL DEFAULT 0,
+        "last_accessed_at" INTEGER,
+        "metadata" TEXT,
+        "key_norm" TEXT,
+        PRIMARY KEY (bucket, key)
+    );`
+
+	createBucketsSQL := `CREATE TABLE IF NOT EXISTS buckets (
+		"bucket_id" TEXT PRIMARY KEY,
+		"email" TEXT NOT NULL UNIQUE,
+		"max_bytes" INTEGER,
+		"webhook_url" TEXT,
+		"webhook_secret" TEXT,
+		"verify_code_hash" TEXT,
+		"json_schema" TEXT,
+		"frozen" INTEGER NOT NULL DEFAULT 0,
+		"rate_limit" REAL,
+		"max_keys" INTEGER
+	);`
+
+	createTokensSQL := `CREATE TABLE IF NOT EXISTS tokens (
+		"token_hash" TEXT PRIMARY KEY,
+		"bucket_id" TEXT NOT NULL REFERENCES buckets (bucket_id),
+		"scope" TEXT NOT NULL DEFAULT 'rw',
+		"created_at" INTEGER
+	);`
+
+	createIdempotencySQL := `CREATE TABLE IF NOT EXISTS idempotency_keys (
+		"bucket" TEXT NOT NULL,
+		"idem_key" TEXT NOT NULL,
+		"fingerprint" TEXT NOT NULL,
+		"status" INTEGER NOT NULL,
+		"created_at" INTEGER NOT NULL,
+		PRIMARY KEY (bucket, idem_key)
+	);`
+
+	createAuditSQL := `CREATE TABLE IF NOT EXISTS audit_log (
+		"id" INTEGER PRIMARY KEY AUTOINCREMENT,
+		"bucket" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"operation" TEXT NOT NULL,
+		"size" INTEGER NOT NULL,
+		"created_at" INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_bucket ON audit_log (bucket, id);`
+
+	createHistorySQL := `CREATE TABLE IF NOT EXISTS kv_history (
+		"bucket" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"version" INTEGER NOT NULL,
+		"value" BLOB,
+		"value_size" INTEGER NOT NULL,
+		"value_flags" INTEGER NOT NULL DEFAULT 0,
+		"content_type" TEXT,
+		"metadata" TEXT,
+		"updated_at" INTEGER,
+		"replaced_at" INTEGER NOT NULL,
+		PRIMARY KEY (bucket, key, version)
+	);`
+
+	createListsSQL := `CREATE TABLE IF NOT EXISTS kv_lists (
+		"bucket" TEXT NOT NULL,
+		"key" TEXT NOT NULL,
+		"idx" INTEGER NOT NULL,
+		"value" BLOB,
+		"value_size" INTEGER NOT NULL,
+		"value_flags" INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (bucket, key, idx)
+	);`
+
+	// Execute creation statements
+	if _, err := db.Exec(createKVSQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createHistorySQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createListsSQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createAuditSQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createIdempotencySQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createBucketsSQL); err != nil {
+		return nil, 0, err
+	}
+	if _, err := db.Exec(createTokensSQL); err != nil {
+		return nil, 0, err
+	}
+
+	schemaVersion, err := migrate(db, sqliteMigrations)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	slog.Info("Database initialized", "driver", "sqlite", "path", dbFile, "journal_mode", journalMode, "schema_version", schemaVersion)
+	return db, schemaVersion, nil
+}
+
+// sqliteMigrations bring the tables created by setupDatabase up to date, in
+// order. Add new migrations to the end and never change released ones.
+var sqliteMigrations = []migration{
+	// Everything added before schema versions were recorded
+	migrateLegacySchema,
+	migrateKeyNorm,
+}
+
+// column names a column and its definition, for adding it to a table.
+type column struct {
+	table, name, definition string
+}
+
+// migrateLegacySchema adds the columns introduced before schema versions were
+// recorded, and moves tokens out of the buckets table.
+func migrateLegacySchema(db *sql.DB) error {
+	for _, c := range []column{
+		{"kv_store", "expires_at", "INTEGER"},
+		{"kv_store", "content_type", "TEXT"},
+		{"kv_store", "created_at", "INTEGER"},
+		{"kv_store", "updated_at", "INTEGER"},
+		{"kv_store", "deleted_at", "INTEGER"},
+		{"kv_store", "value_size", "INTEGER"},
+		{"kv_store", "value_flags", "INTEGER NOT NULL DEFAULT 0"},
+		{"kv_store", "write_ts", "INTEGER"},
+		{"kv_store", "access_count", "INTEGER NOT NULL DEFAULT 0"},
+		{"kv_store", "last_accessed_at", "INTEGER"},
+		{"kv_store", "metadata", "TEXT"},
+		{"kv_history", "metadata", "TEXT"},
+	} {
+		if err := ensureColumn(db, c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	if err := migrateBucketTokens(db); err != nil {
+		return err
+	}
+	for _, c := range []column{
+		{"tokens", "scope", "TEXT NOT NULL DEFAULT 'rw'"},
+		{"buckets", "max_bytes", "INTEGER"},
+		{"buckets", "webhook_url", "TEXT"},
+		{"buckets", "webhook_secret", "TEXT"},
+		{"buckets", "verify_code_hash", "TEXT"},
+		{"buckets", "json_schema", "TEXT"},
+		{"buckets", "frozen", "INTEGER NOT NULL DEFAULT 0"},
+		{"buckets", "rate_limit", "REAL"},
+		{"buckets", "max_keys", "INTEGER"},
+	} {
+		if err := ensureColumn(db, c.table, c.name, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateKeyNorm adds the key_norm column keys are looked up by, filled in
+// with the keys rows are stored at. Rows written under another name by
+// -case-insensitive-keys or -nfc-keys had it in original_key, which becomes
+// their key.
+func migrateKeyNorm(db *sql.DB) error {
+	if err := ensureColumn(db, "kv_store", "key_norm", "TEXT"); err != nil {
+		return err
+	}
+	hasOriginal, err := hasColumn(db, "kv_store", "original_key")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var statements []string
+	if hasOriginal {
+		statements = append(statements,
+			"UPDATE kv_store SET key_norm = key, key = COALESCE(original_key, key)",
+			"ALTER TABLE kv_store DROP COLUMN original_key",
+		)
+	}
+	statements = append(statements,
+		"UPDATE kv_store SET key_norm = key WHERE key_norm IS NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS kv_store_key_norm ON kv_store (bucket, key_norm)",
+	)
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ensureColumn adds a column to an existing table if it is not already present.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %q %s", table, column, definition))
+	return err
+}
+
+// hasColumn reports whether table has a column with the given name.
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?"
+	if err := db.QueryRow(query, table, column).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// migrateBucketTokens moves tokens from the single buckets.token column used by
+// older versions into the tokens table, then rebuilds buckets without it.
+func migrateBucketTokens(db *sql.DB) error {
+	exists, err := hasColumn(db, "buckets", "token")
+	if err != nil || !exists {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Tokens are stored hashed, which SQLite can't compute itself
+	rows, err := tx.Query("SELECT token, bucket_id FROM buckets")
+	if err != nil {
+		return err
+	}
+	var pairs [][2]string
+	for rows.Next() {
+		var token, bucketID string
+		if err := rows.Scan(&token, &bucketID); err != nil {
+			rows.Close()
+			return err
+		}
+		pairs = append(pairs, [2]string{token, bucketID})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		if _, err := tx.Exec("INSERT INTO tokens (token_hash, bucket_id) VALUES (?, ?)", hashToken(p[0]), p[1]); err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		`CREATE TABLE buckets_new (
+			"bucket_id" TEXT PRIMARY KEY,
+			"email" TEXT NOT NULL UNIQUE
+		)`,
+		"INSERT INTO buckets_new (bucket_id, email) SELECT bucket_id, email FROM buckets",
+		"DROP TABLE buckets",
+		"ALTER TABLE buckets_new RENAME TO buckets",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Migrated bucket tokens to the tokens table")
+	return tx.Commit()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBusyRetries checks that a write blocked by another connection's write
+// lock is retried, then fails with errBusy, which handlers answer with 503.
+func TestBusyRetries(t *testing.T) {
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "gokv.db")
+	opts := sqliteOptions{JournalMode: "WAL", BusyTimeout: 10 * time.Millisecond, Synchronous: "NORMAL"}
+	store, err := openSQLite(dbFile, opts, poolOptions{MaxOpenConns: 1}, storeOptions{TxRetries: 2})
+	if err != nil {
+		t.Fatalf("opening database: %v", err)
+	}
+	defer store.Close()
+
+	// A second connection takes the write lock and holds it
+	db, _, err := setupDatabase(dbFile, opts, poolOptions{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatalf("opening second connection: %v", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("Conn: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		t.Fatalf("BEGIN IMMEDIATE: %v", err)
+	}
+
+	retries := txRetryCount.Load()
+	_, err = store.Put(ctx, "test", "k", &Entry{Value: []byte("v")}, PutOptions{})
+	if !errors.Is(err, errBusy) {
+		t.Fatalf("Put: err = %v, want errBusy", err)
+	}
+	if n := txRetryCount.Load() - retries; n != 2 {
+		t.Errorf("Put was retried %d times, want 2", n)
+	}
+
+	w := serve(testRouter(store), http.MethodPost, "/kv/k", "v")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+
+	// Once the lock is released, writes go through again
+	if _, err := conn.ExecContext(ctx, "ROLLBACK"); err != nil {
+		t.Fatalf("ROLLBACK: %v", err)
+	}
+	if _, err := store.Put(ctx, "test", "k", &Entry{Value: []byte("v")}, PutOptions{}); err != nil {
+		t.Errorf("Put after the lock was released: %v", err)
+	}
+}
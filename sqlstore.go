@@ -0,0 +1,1931 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// dialect captures the differences between the SQL databases sqlStore runs on.
+type dialect struct {
+	// numberedParams rewrites ? placeholders as $1, $2, ...
+	numberedParams bool
+	// sizeExpr is an expression for the size of a value in bytes.
+	sizeExpr string
+	// substrExpr is an expression for part of a value, taking the 1-based
+	// offset of its first byte and its length as arguments.
+	substrExpr string
+	// sizeQuery returns the size of the database in bytes.
+	sizeQuery string
+	// txOptions are used for read-modify-write transactions.
+	txOptions *sql.TxOptions
+	// isUniqueViolation reports whether err is a unique constraint failure.
+	isUniqueViolation func(err error) bool
+	// isRetryable reports whether a transaction failed because it conflicted
+	// with another and may succeed if run again. It may be nil.
+	isRetryable func(err error) bool
+	// hasColumn reports whether table has a column with the given name.
+	hasColumn func(db *sql.DB, table, column string) (bool, error)
+	// backup writes a snapshot of the database to w. It may be nil if the
+	// database can't be backed up through the API.
+	backup func(ctx context.Context, db *sql.DB, w io.Writer) error
+}
+
+// Transactions retried by withTx wait txRetryBackoff before the first retry,
+// doubling up to maxTxRetryBackoff, with jitter so contending writers don't
+// collide again.
+const (
+	txRetryBackoff    = 10 * time.Millisecond
+	maxTxRetryBackoff = time.Second
+)
+
+// txRetryCount counts the transactions withTx has retried, across all stores.
+var txRetryCount atomic.Int64
+
+// sqlStore implements Store on top of database/sql. The SQL it issues is
+// portable across the supported databases; anything that isn't is described
+// by its dialect.
+type sqlStore struct {
+	db    *sql.DB
+	d     dialect
+	codec valueCodec
+	// maxVersions is how many previous values are kept per key. Zero
+	// disables history.
+	maxVersions int
+	// tokenPrefix starts every token minted, so tokens are recognizable.
+	tokenPrefix string
+	// txRetries is how often withTx retries a transaction that conflicted
+	// or found the database locked.
+	txRetries int
+	// schemaVersion is the version the schema was migrated to on open.
+	schemaVersion int
+}
+
+// storeOptions configures how a sqlStore stores data, whatever the database.
+type storeOptions struct {
+	// Codec transforms values on their way to and from the database.
+	Codec valueCodec
+	// MaxVersions is how many previous values are kept per key.
+	MaxVersions int
+	// TokenPrefix starts every token minted.
+	TokenPrefix string
+	// TxRetries is how often a transaction is retried before failing with
+	// errBusy.
+	TxRetries int
+}
+
+// newSQLStore returns a sqlStore on db.
+func newSQLStore(db *sql.DB, d dialect, opts storeOptions) *sqlStore {
+	return &sqlStore{db: db, d: d, codec: opts.Codec, maxVersions: opts.MaxVersions, tokenPrefix: opts.TokenPrefix, txRetries: opts.TxRetries}
+}
+
+// newToken mints a random token.
+func (s *sqlStore) newToken() string {
+	return s.tokenPrefix + uuid.NewString()
+}
+
+// sizeCol is an expression for the size of a key's value in bytes. Values are
+// not necessarily stored as given, so their size is recorded on write; rows
+// from older versions fall back to the size of the stored bytes.
+func (s *sqlStore) sizeCol() string {
+	return "COALESCE(value_size, " + s.d.sizeExpr + ")"
+}
+
+// liveCond restricts a query to keys that are neither deleted nor expired. It
+// takes the current unix time as its argument.
+const liveCond = "(deleted_at IS NULL AND (expires_at IS NULL OR expires_at > ?))"
+
+// q adapts a query written with ? placeholders to the dialect.
+func (s *sqlStore) q(query string) string {
+	if !s.d.numberedParams {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// withTx runs fn in a transaction, committing if it returns nil. Transactions
+// that conflict with a concurrent one or find the database locked are retried
+// with backoff, up to txRetries times, after which errBusy is returned.
+func (s *sqlStore) withTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	backoff := txRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.runTx(ctx, fn)
+		if err == nil || s.d.isRetryable == nil || !s.d.isRetryable(err) {
+			return err
+		}
+		if attempt >= s.txRetries {
+			return fmt.Errorf("%w: %w", errBusy, err)
+		}
+
+		txRetryCount.Add(1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff/2 + rand.N(backoff/2)):
+		}
+		backoff = min(backoff*2, maxTxRetryBackoff)
+	}
+}
+
+// runTx makes a single attempt at the transaction for withTx.
+func (s *sqlStore) runTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, s.d.txOptions)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) SchemaVersion() int {
+	return s.schemaVersion
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStore) Backup(ctx context.Context, w io.Writer) error {
+	if s.d.backup == nil {
+		return errNotSupported
+	}
+	return s.d.backup(ctx, s.db, w)
+}
+
+func (s *sqlStore) Vacuum(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, "VACUUM")
+	return err
+}
+
+func (s *sqlStore) Size(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.db.QueryRowContext(ctx, s.d.sizeQuery).Scan(&size)
+	return size, err
+}
+
+func (s *sqlStore) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	query := "SELECT (SELECT COUNT(*) FROM buckets), COUNT(*), COALESCE(CAST(SUM(" + s.sizeCol() + ") AS BIGINT), 0) FROM kv_store WHERE " + liveCond
+	if err := s.db.QueryRowContext(ctx, s.q(query), time.Now().Unix()).Scan(&stats.Buckets, &stats.Keys, &stats.Bytes); err != nil {
+		return nil, err
+	}
+	size, err := s.Size(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stats.DatabaseBytes = size
+	stats.TxRetries = txRetryCount.Load()
+
+	pool := s.db.Stats()
+	stats.Pool = PoolStats{
+		MaxOpen:      pool.MaxOpenConnections,
+		Open:         pool.OpenConnections,
+		InUse:        pool.InUse,
+		Idle:         pool.Idle,
+		WaitCount:    pool.WaitCount,
+		WaitMillis:   pool.WaitDuration.Milliseconds(),
+		ClosedIdle:   pool.MaxIdleClosed,
+		ClosedExpiry: pool.MaxLifetimeClosed,
+	}
+	return &stats, nil
+}
+
+func (s *sqlStore) CreateBucket(ctx context.Context, email, idPrefix string, limits Limits, verifyCode string) (string, string, error) {
+	bucketID := idPrefix + uuid.NewString()
+	token := s.newToken()
+
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		maxBytes := sql.NullInt64{Int64: limits.MaxBytes, Valid: limits.MaxBytes > 0}
+		maxKeys := sql.NullInt64{Int64: limits.MaxKeys, Valid: limits.MaxKeys > 0}
+		// Like tokens, codes are only stored hashed
+		var codeHash sql.NullString
+		if verifyCode != "" {
+			codeHash = sql.NullString{String: hashToken(verifyCode), Valid: true}
+		}
+		// Bucket IDs are random, but tell a clash apart from a reused email
+		// address
+		var exists int
+		query := "SELECT COUNT(*) FROM buckets WHERE bucket_id = ?"
+		if err := tx.QueryRowContext(ctx, s.q(query), bucketID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			return errBucketExists
+		}
+
+		query = "INSERT INTO buckets (bucket_id, email, max_bytes, max_keys, verify_code_hash) VALUES (?, ?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, s.q(query), bucketID, email, maxBytes, maxKeys, codeHash); err != nil {
+			if s.d.isUniqueViolation(err) {
+				return errEmailInUse
+			}
+			return err
+		}
+
+		now := time.Now().Unix()
+		query = "INSERT INTO tokens (token_hash, bucket_id, created_at) VALUES (?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, s.q(query), hashToken(token), bucketID, now); err != nil {
+			return err
+		}
+		return s.audit(ctx, tx, bucketID, "", auditCreateBucket, 0, now)
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return bucketID, token, nil
+}
+
+func (s *sqlStore) VerifyBucket(ctx context.Context, token, code string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var bucketID string
+		var codeHash sql.NullString
+		query := `SELECT b.bucket_id, b.verify_code_hash
+			FROM tokens t JOIN buckets b ON b.bucket_id = t.bucket_id
+			WHERE t.token_hash = ?`
+		err := tx.QueryRowContext(ctx, s.q(query), hashToken(token)).Scan(&bucketID, &codeHash)
+		if err == sql.ErrNoRows {
+			return errNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !codeHash.Valid {
+			return nil
+		}
+		if subtle.ConstantTimeCompare([]byte(codeHash.String), []byte(hashToken(code))) != 1 {
+			return errInvalidCode
+		}
+
+		query = "UPDATE buckets SET verify_code_hash = NULL WHERE bucket_id = ?"
+		_, err = tx.ExecContext(ctx, s.q(query), bucketID)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteBucket(ctx context.Context, bucketID string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		statements := []string{
+			"DELETE FROM kv_store WHERE bucket = ?",
+			"DELETE FROM kv_history WHERE bucket = ?",
+			"DELETE FROM kv_lists WHERE bucket = ?",
+			"DELETE FROM idempotency_keys WHERE bucket = ?",
+			"DELETE FROM tokens WHERE bucket_id = ?",
+			"DELETE FROM buckets WHERE bucket_id = ?",
+		}
+		for _, stmt := range statements {
+			if _, err := tx.ExecContext(ctx, s.q(stmt), bucketID); err != nil {
+				return err
+			}
+		}
+		return s.audit(ctx, tx, bucketID, "", auditDeleteBucket, 0, time.Now().Unix())
+	})
+}
+
+// hashToken returns the form in which a token is stored. Only hashes are kept
+// so a leaked database doesn't reveal working tokens; tokens are random UUIDs,
+// so a plain SHA-256 is enough to make them unrecoverable.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// migrateTokenHashes replaces the plaintext tokens stored by older versions
+// with their hashes.
+func (s *sqlStore) migrateTokenHashes() error {
+	exists, err := s.d.hasColumn(s.db, "tokens", "token")
+	if err != nil || !exists {
+		return err
+	}
+
+	ctx := context.Background()
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE tokens RENAME COLUMN token TO token_hash"); err != nil {
+			return err
+		}
+
+		rows, err := tx.QueryContext(ctx, "SELECT token_hash FROM tokens")
+		if err != nil {
+			return err
+		}
+		var tokens []string
+		for rows.Next() {
+			var token string
+			if err := rows.Scan(&token); err != nil {
+				rows.Close()
+				return err
+			}
+			tokens = append(tokens, token)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, token := range tokens {
+			query := "UPDATE tokens SET token_hash = ? WHERE token_hash = ?"
+			if _, err := tx.ExecContext(ctx, s.q(query), hashToken(token), token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Replaced stored tokens with their hashes")
+	return nil
+}
+
+func (s *sqlStore) ValidateToken(ctx context.Context, token string) (*Auth, error) {
+	var auth Auth
+	var maxBytes, maxKeys sql.NullInt64
+	var codeHash, schema sql.NullString
+	var rateLimit sql.NullFloat64
+	query := `SELECT t.bucket_id, t.scope, b.max_bytes, b.max_keys, b.verify_code_hash, b.json_schema, b.frozen, b.rate_limit
+		FROM tokens t JOIN buckets b ON b.bucket_id = t.bucket_id
+		WHERE t.token_hash = ?`
+	err := s.db.QueryRowContext(ctx, s.q(query), hashToken(token)).Scan(&auth.BucketID, &auth.Scope, &maxBytes, &maxKeys, &codeHash, &schema, &auth.Frozen, &rateLimit)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	auth.Limits.MaxBytes = maxBytes.Int64
+	auth.Limits.MaxKeys = maxKeys.Int64
+	auth.Verified = !codeHash.Valid
+	auth.Schema = schema.String
+	auth.RateLimit = rateLimit.Float64
+	return &auth, nil
+}
+
+func (s *sqlStore) CreateToken(ctx context.Context, bucketID, scope string) (string, error) {
+	token := s.newToken()
+	query := "INSERT INTO tokens (token_hash, bucket_id, scope, created_at) VALUES (?, ?, ?, ?)"
+	if _, err := s.db.ExecContext(ctx, s.q(query), hashToken(token), bucketID, scope, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *sqlStore) RotateToken(ctx context.Context, token string) (string, error) {
+	newToken := s.newToken()
+	query := "UPDATE tokens SET token_hash = ?, created_at = ? WHERE token_hash = ?"
+	result, err := s.db.ExecContext(ctx, s.q(query), hashToken(newToken), time.Now().Unix(), hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if err := expectRows(result); err != nil {
+		return "", err
+	}
+	return newToken, nil
+}
+
+func (s *sqlStore) RevokeToken(ctx context.Context, bucketID, token string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		var exists, total int64
+		query := "SELECT COUNT(CASE WHEN token_hash = ? THEN 1 END), COUNT(*) FROM tokens WHERE bucket_id = ?"
+		if err := tx.QueryRowContext(ctx, s.q(query), hashToken(token), bucketID).Scan(&exists, &total); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errNotFound
+		}
+		if total == 1 {
+			return errLastToken
+		}
+
+		query = "DELETE FROM tokens WHERE token_hash = ? AND bucket_id = ?"
+		result, err := tx.ExecContext(ctx, s.q(query), hashToken(token), bucketID)
+		if err != nil {
+			return err
+		}
+		return expectRows(result)
+	})
+}
+
+func (s *sqlStore) SetWebhook(ctx context.Context, bucketID, url, secret string) error {
+	query := "UPDATE buckets SET webhook_url = ?, webhook_secret = ? WHERE bucket_id = ?"
+	_, err := s.db.ExecContext(ctx, s.q(query), sql.NullString{String: url, Valid: url != ""}, sql.NullString{String: secret, Valid: url != ""}, bucketID)
+	return err
+}
+
+func (s *sqlStore) SetSchema(ctx context.Context, bucketID, schema string) error {
+	query := "UPDATE buckets SET json_schema = ? WHERE bucket_id = ?"
+	_, err := s.db.ExecContext(ctx, s.q(query), sql.NullString{String: schema, Valid: schema != ""}, bucketID)
+	return err
+}
+
+func (s *sqlStore) SetFrozen(ctx context.Context, bucketID string, frozen bool) error {
+	query := "UPDATE buckets SET frozen = ? WHERE bucket_id = ?"
+	result, err := s.db.ExecContext(ctx, s.q(query), frozen, bucketID)
+	if err != nil {
+		return err
+	}
+	return expectRows(result)
+}
+
+func (s *sqlStore) SetRateLimit(ctx context.Context, bucketID string, rps float64) error {
+	query := "UPDATE buckets SET rate_limit = ? WHERE bucket_id = ?"
+	result, err := s.db.ExecContext(ctx, s.q(query), sql.NullFloat64{Float64: rps, Valid: rps > 0}, bucketID)
+	if err != nil {
+		return err
+	}
+	return expectRows(result)
+}
+
+func (s *sqlStore) Webhook(ctx context.Context, bucketID string) (string, string, error) {
+	var url, secret sql.NullString
+	query := "SELECT webhook_url, webhook_secret FROM buckets WHERE bucket_id = ?"
+	err := s.db.QueryRowContext(ctx, s.q(query), bucketID).Scan(&url, &secret)
+	if err == sql.ErrNoRows || (err == nil && !url.Valid) {
+		return "", "", errNotFound
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return url.String, secret.String, nil
+}
+
+func (s *sqlStore) CountBuckets(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM buckets").Scan(&count)
+	return count, err
+}
+
+func (s *sqlStore) ListBuckets(ctx context.Context, after string, limit int) ([]BucketInfo, error) {
+	// Usage is aggregated per bucket first so buckets without keys still show up
+	query := "SELECT b.bucket_id, b.email, COALESCE(u.key_count, 0), COALESCE(u.total_bytes, 0), b.frozen, b.rate_limit FROM buckets b" +
+		" LEFT JOIN (SELECT bucket, COUNT(*) AS key_count, CAST(SUM(" + s.sizeCol() + ") AS BIGINT) AS total_bytes" +
+		" FROM kv_store WHERE " + liveCond + " GROUP BY bucket) u ON u.bucket = b.bucket_id" +
+		" WHERE b.bucket_id > ? ORDER BY b.bucket_id LIMIT ?"
+	rows, err := s.db.QueryContext(ctx, s.q(query), time.Now().Unix(), after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []BucketInfo{}
+	for rows.Next() {
+		var b BucketInfo
+		var rateLimit sql.NullFloat64
+		if err := rows.Scan(&b.ID, &b.Email, &b.Keys, &b.Bytes, &b.Frozen, &rateLimit); err != nil {
+			return nil, err
+		}
+		if rateLimit.Valid {
+			b.RateLimit = &rateLimit.Float64
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// expectRows returns errNotFound if a statement affected no rows.
+func expectRows(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, bucket, key string) (*Entry, error) {
+	entry, stored, flags, err := s.load(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	entry.Value, err = s.codec.decode(bucket, key, stored, flags)
+	if err != nil {
+		return nil, err
+	}
+	entry.Size = int64(len(entry.Value))
+	return entry, nil
+}
+
+func (s *sqlStore) Open(ctx context.Context, bucket, key string) (*Entry, io.ReadCloser, error) {
+	entry, stored, flags, err := s.load(ctx, bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Files of values stored as is are named after their digest, which gives
+	// the ETag without reading them
+	if flags == valueFile {
+		f, size, err := s.codec.openBlob(stored)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.Size = size
+		entry.ETag = `"` + string(stored[:32]) + `"`
+		return entry, f, nil
+	}
+
+	value, err := s.codec.decode(bucket, key, stored, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry.Size = int64(len(value))
+	entry.ETag = etag(value)
+	return entry, io.NopCloser(bytes.NewReader(value)), nil
+}
+
+// load returns the entry stored at key without its value, along with the
+// value as stored and its flags.
+func (s *sqlStore) load(ctx context.Context, bucket, key string) (*Entry, []byte, int64, error) {
+	var entry Entry
+	var stored []byte
+	var flags int64
+	var contentType, metadata sql.NullString
+	var expiresAt, createdAt, updatedAt, writeTS sql.NullInt64
+	query := "SELECT value, value_flags, content_type, metadata, expires_at, created_at, updated_at, write_ts FROM kv_store WHERE bucket = ? AND key_norm = ? AND deleted_at IS NULL"
+	err := s.db.QueryRowContext(ctx, s.q(query), bucket, key).Scan(&stored, &flags, &contentType, &metadata, &expiresAt, &createdAt, &updatedAt, &writeTS)
+	if err == sql.ErrNoRows {
+		return nil, nil, 0, errNotFound
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	now := time.Now().Unix()
+	if expiresAt.Valid && expiresAt.Int64 <= now {
+		// Lazily remove the expired key. The expiry is re-checked so a
+		// concurrent write that refreshed the key is not lost.
+		query := "DELETE FROM kv_store WHERE bucket = ? AND key_norm = ? AND deleted_at IS NULL AND expires_at <= ?"
+		if _, err := s.db.ExecContext(ctx, s.q(query), bucket, key, now); err != nil {
+			return nil, nil, 0, err
+		}
+		return nil, nil, 0, errNotFound
+	}
+
+	entry.ContentType = contentType.String
+	entry.Metadata = metadata.String
+	entry.ExpiresAt = unixTime(expiresAt)
+	entry.CreatedAt = unixTime(createdAt)
+	entry.UpdatedAt = unixTime(updatedAt)
+	entry.WriteTime = unixNanoTime(writeTS)
+	return &entry, stored, flags, nil
+}
+
+func (s *sqlStore) GetRange(ctx context.Context, bucket, key string, resolve func(size int64) (int64, int64, error)) (*Entry, int64, error) {
+	var entry Entry
+	var offset int64
+	// The size and the bytes are read in one transaction so they agree
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var flags int64
+		var contentType, metadata sql.NullString
+		var expiresAt, createdAt, updatedAt, writeTS sql.NullInt64
+		query := "SELECT " + s.sizeCol() + ", value_flags, content_type, metadata, expires_at, created_at, updated_at, write_ts FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+		err := tx.QueryRowContext(ctx, s.q(query), bucket, key, time.Now().Unix()).Scan(&entry.Size, &flags, &contentType, &metadata, &expiresAt, &createdAt, &updatedAt, &writeTS)
+		if err == sql.ErrNoRows {
+			return errNotFound
+		}
+		if err != nil {
+			return err
+		}
+		entry.ContentType = contentType.String
+		entry.Metadata = metadata.String
+		entry.ExpiresAt = unixTime(expiresAt)
+		entry.CreatedAt = unixTime(createdAt)
+		entry.UpdatedAt = unixTime(updatedAt)
+		entry.WriteTime = unixNanoTime(writeTS)
+
+		var length int64
+		offset, length, err = resolve(entry.Size)
+		if err != nil {
+			return err
+		}
+
+		// Values stored as is can be sliced by the database or read from
+		// their file in part; encoded ones have to be decoded in full first
+		if flags == 0 {
+			query = "SELECT " + s.d.substrExpr + " FROM kv_store WHERE bucket = ? AND key_norm = ?"
+			return tx.QueryRowContext(ctx, s.q(query), offset+1, length, bucket, key).Scan(&entry.Value)
+		}
+		var stored []byte
+		query = "SELECT value FROM kv_store WHERE bucket = ? AND key_norm = ?"
+		if err := tx.QueryRowContext(ctx, s.q(query), bucket, key).Scan(&stored); err != nil {
+			return err
+		}
+		if flags == valueFile {
+			entry.Value, err = s.codec.readBlobRange(stored, offset, length)
+			return err
+		}
+		value, err := s.codec.decode(bucket, key, stored, flags)
+		if err != nil {
+			return err
+		}
+		entry.Value = value[offset : offset+length]
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return &entry, offset, nil
+}
+
+func (s *sqlStore) Stat(ctx context.Context, bucket, key string) (*Entry, error) {
+	var entry Entry
+	var contentType, metadata sql.NullString
+	var expiresAt, createdAt, updatedAt, writeTS, lastAccessedAt sql.NullInt64
+	query := "SELECT " + s.sizeCol() + ", content_type, metadata, expires_at, created_at, updated_at, write_ts, access_count, last_accessed_at FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+	err := s.db.QueryRowContext(ctx, s.q(query), bucket, key, time.Now().Unix()).Scan(&entry.Size, &contentType, &metadata, &expiresAt, &createdAt, &updatedAt, &writeTS, &entry.AccessCount, &lastAccessedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ContentType = contentType.String
+	entry.Metadata = metadata.String
+	entry.ExpiresAt = unixTime(expiresAt)
+	entry.CreatedAt = unixTime(createdAt)
+	entry.UpdatedAt = unixTime(updatedAt)
+	entry.WriteTime = unixNanoTime(writeTS)
+	entry.LastAccessedAt = unixTime(lastAccessedAt)
+	return &entry, nil
+}
+
+func (s *sqlStore) SetMetadata(ctx context.Context, bucket, key, metadata string) error {
+	now := time.Now().Unix()
+	query := "UPDATE kv_store SET metadata = ?, updated_at = ? WHERE bucket = ? AND key_norm = ? AND " + liveCond
+	result, err := s.db.ExecContext(ctx, s.q(query), sql.NullString{String: metadata, Valid: metadata != ""}, now, bucket, key, now)
+	if err != nil {
+		return err
+	}
+	return expectRows(result)
+}
+
+func (s *sqlStore) Touch(ctx context.Context, bucket, key string, expiresAt time.Time) error {
+	// Checking the key is live in the same statement keeps a touch from
+	// bringing back a key that expired a moment before
+	query := "UPDATE kv_store SET expires_at = ? WHERE bucket = ? AND key_norm = ? AND " + liveCond
+	result, err := s.db.ExecContext(ctx, s.q(query), expiresAt.Unix(), bucket, key, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return expectRows(result)
+}
+
+func (s *sqlStore) RecordAccess(ctx context.Context, bucket, key string) error {
+	query := "UPDATE kv_store SET access_count = access_count + 1, last_accessed_at = ? WHERE bucket = ? AND key_norm = ? AND deleted_at IS NULL"
+	_, err := s.db.ExecContext(ctx, s.q(query), time.Now().Unix(), bucket, key)
+	return err
+}
+
+// unixTime converts a nullable unix timestamp column to a time, with NULL
+// becoming the zero time.
+func unixTime(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(n.Int64, 0)
+}
+
+// unixNanoTime is like unixTime for timestamps in nanoseconds.
+func unixNanoTime(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64)
+}
+
+func (s *sqlStore) WriteBlob(ctx context.Context, bucket string, r io.Reader) (string, int64, error) {
+	return s.codec.copyBlob(r)
+}
+
+func (s *sqlStore) Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (bool, error) {
+	var created bool
+	// The precondition check and the write share a transaction so no other
+	// writer can change the key in between, or create it after the check
+	// for whether it exists.
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+
+		if opts.Idempotency != nil {
+			if err := s.checkIdempotency(ctx, tx, bucket, opts.Idempotency, now); err != nil {
+				return err
+			}
+		}
+
+		exists, err := s.keyExists(ctx, tx, bucket, key, now)
+		if err != nil {
+			return err
+		}
+		created = !exists
+		if opts.IfNoneMatch && exists {
+			return errKeyExists
+		}
+		if opts.IfMatch != "" {
+			var current []byte
+			var flags int64
+			query := "SELECT value, value_flags FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+			err := tx.QueryRowContext(ctx, s.q(query), bucket, key, now).Scan(&current, &flags)
+			if err == sql.ErrNoRows {
+				return errPreconditionFailed
+			}
+			if err != nil {
+				return err
+			}
+			if current, err = s.codec.decode(bucket, key, current, flags); err != nil {
+				return err
+			}
+			if !matchesETag(opts.IfMatch, etag(current)) {
+				return errPreconditionFailed
+			}
+		}
+
+		if opts.LastWriteWins {
+			// Values stored by older versions have no timestamp and lose
+			var current sql.NullInt64
+			query := "SELECT write_ts FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+			err := tx.QueryRowContext(ctx, s.q(query), bucket, key, now).Scan(&current)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			if current.Valid && current.Int64 >= entry.WriteTime.UnixNano() {
+				return &staleWriteError{Current: time.Unix(0, current.Int64)}
+			}
+		}
+
+		if err := s.checkQuota(ctx, tx, bucket, opts.Limits, map[string]int64{key: entry.valueSize()}, now); err != nil {
+			return err
+		}
+		if opts.DryRun {
+			return nil
+		}
+		if err := s.upsert(ctx, tx, bucket, key, entry, now); err != nil {
+			return err
+		}
+		if err := s.audit(ctx, tx, bucket, key, auditPut, entry.valueSize(), now); err != nil {
+			return err
+		}
+
+		if opts.Idempotency != nil {
+			status := opts.Idempotency.Status
+			if exists && opts.Idempotency.UpdatedStatus != 0 {
+				status = opts.Idempotency.UpdatedStatus
+			}
+			query := "INSERT INTO idempotency_keys (bucket, idem_key, fingerprint, status, created_at) VALUES (?, ?, ?, ?, ?)"
+			_, err := tx.ExecContext(ctx, s.q(query), bucket, opts.Idempotency.Key, opts.Idempotency.Fingerprint, status, now)
+			return err
+		}
+		return nil
+	})
+	return created, err
+}
+
+// keyExists reports within tx whether a live entry is stored at key.
+func (s *sqlStore) keyExists(ctx context.Context, tx *sql.Tx, bucket, key string, now int64) (bool, error) {
+	var exists int
+	query := "SELECT 1 FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+	err := tx.QueryRowContext(ctx, s.q(query), bucket, key, now).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkIdempotency looks up an idempotency key within tx. It returns a
+// *replayedError if the request was already processed, or
+// errIdempotencyReused if the key was used for a different request. Expired
+// keys of the bucket are removed on the way.
+func (s *sqlStore) checkIdempotency(ctx context.Context, tx *sql.Tx, bucket string, idem *Idempotency, now int64) error {
+	cutoff := now - int64(idem.TTL.Seconds())
+	query := "DELETE FROM idempotency_keys WHERE bucket = ? AND created_at <= ?"
+	if _, err := tx.ExecContext(ctx, s.q(query), bucket, cutoff); err != nil {
+		return err
+	}
+
+	var fingerprint string
+	var status int
+	query = "SELECT fingerprint, status FROM idempotency_keys WHERE bucket = ? AND idem_key = ?"
+	err := tx.QueryRowContext(ctx, s.q(query), bucket, idem.Key).Scan(&fingerprint, &status)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fingerprint != idem.Fingerprint {
+		return errIdempotencyReused
+	}
+	return &replayedError{Status: status}
+}
+
+// upsert creates or replaces a key within tx. It upserts rather than replacing
+// the row so created_at survives updates; a key that had expired or was in the
+// trash is being created afresh, so it gets a new created_at.
+func (s *sqlStore) upsert(ctx context.Context, tx *sql.Tx, bucket, key string, entry *Entry, now int64) error {
+	contentType := sql.NullString{String: entry.ContentType, Valid: entry.ContentType != ""}
+	metadata := sql.NullString{String: entry.Metadata, Valid: entry.Metadata != ""}
+	// An entry written without a name keeps the one it has, if any
+	name := sql.NullString{String: entry.Key, Valid: entry.Key != ""}
+	var expiresAt sql.NullInt64
+	if !entry.ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: entry.ExpiresAt.Unix(), Valid: true}
+	}
+
+	// A value already written to a file is stored as it is
+	stored, flags := []byte(entry.Blob), int64(valueFile)
+	if entry.Blob == "" {
+		var err error
+		if stored, flags, err = s.codec.encode(bucket, key, entry.Value); err != nil {
+			return err
+		}
+	}
+	if err := s.archive(ctx, tx, bucket, key, now); err != nil {
+		return err
+	}
+	writeTime := entry.WriteTime
+	if writeTime.IsZero() {
+		writeTime = time.Now()
+	}
+
+	query := `INSERT INTO kv_store (bucket, key_norm, key, value, value_size, value_flags, content_type, metadata, expires_at, created_at, updated_at, write_ts)
+		VALUES (?, ?, COALESCE(?, ?), ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (bucket, key_norm) DO UPDATE SET
+			key = COALESCE(?, kv_store.key),
+			value = excluded.value,
+			write_ts = excluded.write_ts,
+			value_size = excluded.value_size,
+			value_flags = excluded.value_flags,
+			content_type = excluded.content_type,
+			metadata = excluded.metadata,
+			expires_at = excluded.expires_at,
+			updated_at = excluded.updated_at,
+			deleted_at = NULL,
+			created_at = CASE
+				WHEN kv_store.deleted_at IS NOT NULL THEN excluded.created_at
+				WHEN kv_store.expires_at IS NOT NULL AND kv_store.expires_at <= excluded.updated_at THEN excluded.created_at
+				ELSE kv_store.created_at
+			END`
+	_, err := tx.ExecContext(ctx, s.q(query), bucket, key, name, key, stored, entry.valueSize(), flags, contentType, metadata, expiresAt, now, now, writeTime.UnixNano(), name)
+	return err
+}
+
+// archive copies the value about to be overwritten at key, if any, to the
+// key's history within tx, and prunes versions beyond maxVersions. Values are
+// copied as stored, so encrypted ones stay encrypted. Trashed and expired
+// values are not archived: a write over them starts the key afresh.
+func (s *sqlStore) archive(ctx context.Context, tx *sql.Tx, bucket, key string, now int64) error {
+	if s.maxVersions <= 0 {
+		return nil
+	}
+
+	query := `INSERT INTO kv_history (bucket, key, version, value, value_size, value_flags, content_type, metadata, updated_at, replaced_at)
+		SELECT bucket, key_norm, (SELECT COALESCE(MAX(version), 0) + 1 FROM kv_history WHERE bucket = ? AND key = ?),
+			value, ` + s.sizeCol() + `, value_flags, content_type, metadata, updated_at, ?
+		FROM kv_store WHERE bucket = ? AND key_norm = ? AND ` + liveCond
+	result, err := tx.ExecContext(ctx, s.q(query), bucket, key, now, bucket, key, now)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	query = `DELETE FROM kv_history WHERE bucket = ? AND key = ? AND version <=
+		(SELECT MAX(version) FROM kv_history WHERE bucket = ? AND key = ?) - ?`
+	_, err = tx.ExecContext(ctx, s.q(query), bucket, key, bucket, key, s.maxVersions)
+	return err
+}
+
+func (s *sqlStore) History(ctx context.Context, bucket, key string) ([]Version, error) {
+	query := "SELECT version, value_size, content_type, updated_at, replaced_at FROM kv_history WHERE bucket = ? AND key = ? ORDER BY version DESC"
+	rows, err := s.db.QueryContext(ctx, s.q(query), bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []Version{}
+	for rows.Next() {
+		var v Version
+		var contentType sql.NullString
+		var updatedAt sql.NullInt64
+		var replacedAt int64
+		if err := rows.Scan(&v.Version, &v.Size, &contentType, &updatedAt, &replacedAt); err != nil {
+			return nil, err
+		}
+		v.ContentType = contentType.String
+		v.UpdatedAt = unixTime(updatedAt)
+		v.ReplacedAt = time.Unix(replacedAt, 0)
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func (s *sqlStore) GetVersion(ctx context.Context, bucket, key string, version int64) (*Entry, error) {
+	return s.getVersion(ctx, s.db, bucket, key, version)
+}
+
+func (s *sqlStore) Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (*Entry, error) {
+	var reverted *Entry
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+
+		entry, err := s.getVersion(ctx, tx, bucket, key, version)
+		if err != nil {
+			return err
+		}
+		if err := s.checkQuota(ctx, tx, bucket, limits, map[string]int64{key: entry.Size}, now); err != nil {
+			return err
+		}
+		if err := s.upsert(ctx, tx, bucket, key, entry, now); err != nil {
+			return err
+		}
+		if err := s.audit(ctx, tx, bucket, key, auditRevert, entry.Size, now); err != nil {
+			return err
+		}
+
+		entry.UpdatedAt = time.Unix(now, 0)
+		reverted = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// getVersion reads a version of key from the history through q, which may be
+// the database or a transaction.
+func (s *sqlStore) getVersion(ctx context.Context, q interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}, bucket, key string, version int64) (*Entry, error) {
+	var entry Entry
+	var stored []byte
+	var flags int64
+	var contentType, metadata sql.NullString
+	var updatedAt sql.NullInt64
+	query := "SELECT value, value_flags, content_type, metadata, updated_at FROM kv_history WHERE bucket = ? AND key = ? AND version = ?"
+	err := q.QueryRowContext(ctx, s.q(query), bucket, key, version).Scan(&stored, &flags, &contentType, &metadata, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if entry.Value, err = s.codec.decode(bucket, key, stored, flags); err != nil {
+		return nil, err
+	}
+	entry.Size = int64(len(entry.Value))
+	entry.ContentType = contentType.String
+	entry.Metadata = metadata.String
+	entry.UpdatedAt = unixTime(updatedAt)
+	return &entry, nil
+}
+
+// audit records a change within the transaction that makes it, so a change
+// that is rolled back leaves no trace in the audit log.
+func (s *sqlStore) audit(ctx context.Context, tx *sql.Tx, bucket, key, operation string, size, now int64) error {
+	query := "INSERT INTO audit_log (bucket, key, operation, size, created_at) VALUES (?, ?, ?, ?, ?)"
+	_, err := tx.ExecContext(ctx, s.q(query), bucket, key, operation, size, now)
+	return err
+}
+
+func (s *sqlStore) Audit(ctx context.Context, aq AuditQuery) ([]AuditRecord, error) {
+	query := "SELECT id, bucket, key, operation, size, created_at FROM audit_log WHERE id > ?"
+	args := []any{aq.After}
+	if aq.Bucket != "" {
+		query += " AND bucket = ?"
+		args = append(args, aq.Bucket)
+	}
+	if !aq.Since.IsZero() {
+		query += " AND created_at >= ?"
+		args = append(args, aq.Since.Unix())
+	}
+	if !aq.Until.IsZero() {
+		query += " AND created_at < ?"
+		args = append(args, aq.Until.Unix())
+	}
+	query += " ORDER BY id LIMIT ?"
+	args = append(args, aq.Limit)
+
+	rows, err := s.db.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []AuditRecord{}
+	for rows.Next() {
+		var r AuditRecord
+		var createdAt int64
+		if err := rows.Scan(&r.ID, &r.Bucket, &r.Key, &r.Operation, &r.Size, &createdAt); err != nil {
+			return nil, err
+		}
+		r.Time = time.Unix(createdAt, 0).UTC()
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// checkQuota returns errQuotaExceeded if writing values of the given sizes
+// would take the bucket past its storage quota, or errKeyLimitExceeded if it
+// would create keys beyond its key limit. The keys being written replace any
+// existing values, so those don't count towards the current usage.
+func (s *sqlStore) checkQuota(ctx context.Context, tx *sql.Tx, bucket string, limits Limits, sizes map[string]int64, now int64) error {
+	if err := s.checkKeyLimit(ctx, tx, bucket, limits, sizes, 0, now); err != nil {
+		return err
+	}
+	if limits.MaxBytes == 0 {
+		return nil
+	}
+
+	var incoming int64
+	for _, size := range sizes {
+		incoming += size
+	}
+	used, err := s.usedBytes(ctx, tx, bucket, sizes, now)
+	if err != nil {
+		return err
+	}
+	if used+incoming > limits.MaxBytes {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// usedBytes returns the bytes a bucket's values and lists take up towards its
+// quota, leaving out the values of the keys in exclude.
+func (s *sqlStore) usedBytes(ctx context.Context, tx *sql.Tx, bucket string, exclude map[string]int64, now int64) (int64, error) {
+	args := []any{bucket, now}
+	query := "SELECT CAST(COALESCE(SUM(" + s.sizeCol() + "), 0) AS BIGINT) FROM kv_store WHERE bucket = ? AND " + liveCond
+	if len(exclude) > 0 {
+		query += " AND key_norm NOT IN (" + placeholders(len(exclude)) + ")"
+		for key := range exclude {
+			args = append(args, key)
+		}
+	}
+	var values, lists int64
+	if err := tx.QueryRowContext(ctx, s.q(query), args...).Scan(&values); err != nil {
+		return 0, err
+	}
+	query = "SELECT CAST(COALESCE(SUM(value_size), 0) AS BIGINT) FROM kv_lists WHERE bucket = ?"
+	if err := tx.QueryRowContext(ctx, s.q(query), bucket).Scan(&lists); err != nil {
+		return 0, err
+	}
+	return values + lists, nil
+}
+
+// checkKeyLimit returns errKeyLimitExceeded if writing the keys of sizes and
+// creating newLists lists would create keys beyond the bucket's key limit.
+// Each list counts as a key. Writes that only replace existing keys are always
+// allowed, even if the limit has since been lowered.
+func (s *sqlStore) checkKeyLimit(ctx context.Context, tx *sql.Tx, bucket string, limits Limits, sizes map[string]int64, newLists, now int64) error {
+	if limits.MaxKeys == 0 || (len(sizes) == 0 && newLists == 0) {
+		return nil
+	}
+
+	replacedCond := "1 = 0"
+	args := make([]any, 0, len(sizes)+2)
+	if len(sizes) > 0 {
+		replacedCond = "key_norm IN (" + placeholders(len(sizes)) + ")"
+		for key := range sizes {
+			args = append(args, key)
+		}
+	}
+	args = append(args, bucket, now)
+
+	var values, lists, replaced int64
+	query := "SELECT COUNT(*), COUNT(CASE WHEN " + replacedCond + " THEN 1 END) FROM kv_store WHERE bucket = ? AND " + liveCond
+	if err := tx.QueryRowContext(ctx, s.q(query), args...).Scan(&values, &replaced); err != nil {
+		return err
+	}
+	query = "SELECT COUNT(DISTINCT key) FROM kv_lists WHERE bucket = ?"
+	if err := tx.QueryRowContext(ctx, s.q(query), bucket).Scan(&lists); err != nil {
+		return err
+	}
+	created := int64(len(sizes)) - replaced + newLists
+	if created > 0 && values+lists+created > limits.MaxKeys {
+		return errKeyLimitExceeded
+	}
+	return nil
+}
+
+func (s *sqlStore) Delete(ctx context.Context, bucket, key string) error {
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		return s.deleteKey(ctx, tx, bucket, key, time.Now().Unix())
+	})
+}
+
+func (s *sqlStore) DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) error {
+	// As with Put, the check and the delete share a transaction
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		if err := s.checkMatch(ctx, tx, bucket, key, ifMatch, now); err != nil {
+			return err
+		}
+		return s.deleteKey(ctx, tx, bucket, key, now)
+	})
+}
+
+func (s *sqlStore) Release(ctx context.Context, bucket, key, token string) error {
+	// The lock's value is its token, so comparing ETags compares tokens
+	return s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		if err := s.checkMatch(ctx, tx, bucket, key, etag([]byte(token)), now); err != nil {
+			return err
+		}
+
+		var size int64
+		query := "DELETE FROM kv_store WHERE bucket = ? AND key_norm = ? RETURNING " + s.sizeCol()
+		if err := tx.QueryRowContext(ctx, s.q(query), bucket, key).Scan(&size); err != nil {
+			return err
+		}
+		if err := dropOrphanHistory(ctx, tx); err != nil {
+			return err
+		}
+		return s.audit(ctx, tx, bucket, key, auditDelete, size, now)
+	})
+}
+
+// checkMatch returns errNotFound if no live entry is stored at key, and
+// errPreconditionFailed if its ETag doesn't match ifMatch.
+func (s *sqlStore) checkMatch(ctx context.Context, tx *sql.Tx, bucket, key, ifMatch string, now int64) error {
+	var current []byte
+	var flags int64
+	query := "SELECT value, value_flags FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+	err := tx.QueryRowContext(ctx, s.q(query), bucket, key, now).Scan(&current, &flags)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if current, err = s.codec.decode(bucket, key, current, flags); err != nil {
+		return err
+	}
+	if !matchesETag(ifMatch, etag(current)) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// deleteKey moves the entry stored at key to the trash within tx.
+func (s *sqlStore) deleteKey(ctx context.Context, tx *sql.Tx, bucket, key string, now int64) error {
+	// Deleted keys are only marked, so they can be restored until purged.
+	// Expired keys are treated as already gone.
+	var size int64
+	query := "UPDATE kv_store SET deleted_at = ? WHERE bucket = ? AND key_norm = ? AND " + liveCond + " RETURNING " + s.sizeCol()
+	err := tx.QueryRowContext(ctx, s.q(query), now, bucket, key, now).Scan(&size)
+	if err == sql.ErrNoRows {
+		return errNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return s.audit(ctx, tx, bucket, key, auditDelete, size, now)
+}
+
+func (s *sqlStore) DeletePrefix(ctx context.Context, bucket, prefix string) (int64, error) {
+	var deleted []string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = s.trash(ctx, tx, bucket, `key_norm LIKE ? ESCAPE '\'`, escapeLike(prefix)+"%")
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(deleted)), nil
+}
+
+func (s *sqlStore) DeleteMany(ctx context.Context, bucket string, keys []string) ([]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	var deleted []string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = s.trash(ctx, tx, bucket, "key_norm IN ("+placeholders(len(keys))+")", args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// trash moves the live entries of bucket matching cond to the trash within tx,
+// audits their deletion and returns their keys.
+func (s *sqlStore) trash(ctx context.Context, tx *sql.Tx, bucket, cond string, condArgs ...any) ([]string, error) {
+	now := time.Now().Unix()
+	query := "UPDATE kv_store SET deleted_at = ? WHERE bucket = ? AND " + liveCond + " AND " + cond +
+		" RETURNING key_norm, " + s.sizeCol()
+	rows, err := tx.QueryContext(ctx, s.q(query), append([]any{now, bucket, now}, condArgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	// Read every deleted key before auditing, as the transaction can only
+	// run one statement at a time
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var key string
+		var size int64
+		if err := rows.Scan(&key, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sizes[key] = size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(sizes))
+	for key, size := range sizes {
+		if err := s.audit(ctx, tx, bucket, key, auditDelete, size, now); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (s *sqlStore) Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (*Entry, error) {
+	var restored *Entry
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+
+		var value []byte
+		var flags int64
+		var contentType sql.NullString
+		var expiresAt, createdAt, updatedAt sql.NullInt64
+		query := "SELECT value, value_flags, content_type, expires_at, created_at, updated_at FROM kv_store WHERE bucket = ? AND key_norm = ? AND deleted_at > ?"
+		err := tx.QueryRowContext(ctx, s.q(query), bucket, key, deletedSince.Unix()).Scan(&value, &flags, &contentType, &expiresAt, &createdAt, &updatedAt)
+		if err == sql.ErrNoRows {
+			return errNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if value, err = s.codec.decode(bucket, key, value, flags); err != nil {
+			return err
+		}
+
+		// The restored value counts towards the quota again
+		if err := s.checkQuota(ctx, tx, bucket, limits, map[string]int64{key: int64(len(value))}, now); err != nil {
+			return err
+		}
+		query = "UPDATE kv_store SET deleted_at = NULL WHERE bucket = ? AND key_norm = ?"
+		if _, err := tx.ExecContext(ctx, s.q(query), bucket, key); err != nil {
+			return err
+		}
+		if err := s.audit(ctx, tx, bucket, key, auditRestore, int64(len(value)), now); err != nil {
+			return err
+		}
+
+		restored = &Entry{
+			Value:       value,
+			Size:        int64(len(value)),
+			ContentType: contentType.String,
+			ExpiresAt:   unixTime(expiresAt),
+			CreatedAt:   unixTime(createdAt),
+			UpdatedAt:   unixTime(updatedAt),
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return restored, nil
+}
+
+func (s *sqlStore) Purge(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	var purged int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		query := "DELETE FROM kv_store WHERE deleted_at <= ?"
+		result, err := tx.ExecContext(ctx, s.q(query), deletedBefore.Unix())
+		if err != nil {
+			return err
+		}
+		if purged, err = result.RowsAffected(); err != nil || purged == 0 {
+			return err
+		}
+		return dropOrphanHistory(ctx, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (s *sqlStore) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		// Deleted keys stay in the trash for the retention period even if
+		// they have expired since; Purge removes them
+		query := "DELETE FROM kv_store WHERE deleted_at IS NULL AND expires_at IS NOT NULL AND expires_at <= ?"
+		result, err := tx.ExecContext(ctx, s.q(query), now.Unix())
+		if err != nil {
+			return err
+		}
+		if deleted, err = result.RowsAffected(); err != nil || deleted == 0 {
+			return err
+		}
+		return dropOrphanHistory(ctx, tx)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *sqlStore) PurgeBlobs(ctx context.Context, writtenBefore time.Time) (int64, error) {
+	if s.codec.blobDir == "" {
+		return 0, nil
+	}
+
+	// Versions and keys in the trash keep their files too
+	referenced := map[string]bool{}
+	query := `SELECT value FROM kv_store WHERE value_flags & ? <> 0
+		UNION SELECT value FROM kv_history WHERE value_flags & ? <> 0
+		UNION SELECT value FROM kv_lists WHERE value_flags & ? <> 0`
+	rows, err := s.db.QueryContext(ctx, s.q(query), valueFile, valueFile, valueFile)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name []byte
+		if err := rows.Scan(&name); err != nil {
+			return 0, err
+		}
+		referenced[string(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	return s.codec.removeBlobs(referenced, writtenBefore)
+}
+
+func (s *sqlStore) NormalizeKeys(ctx context.Context, normalize func(name string) string) (int64, error) {
+	var renamed int64
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		renamed = 0
+
+		// Entries are looked up by their normalized name, and their
+		// history by the same key
+		query := "SELECT bucket, key, key_norm FROM kv_store ORDER BY bucket, key_norm"
+		rows, err := tx.QueryContext(ctx, s.q(query))
+		if err != nil {
+			return err
+		}
+		type rename struct{ bucket, from, to string }
+		var renames []rename
+		named := map[[2]string]string{}
+		for rows.Next() {
+			var bucket, name, key string
+			if err := rows.Scan(&bucket, &name, &key); err != nil {
+				rows.Close()
+				return err
+			}
+			to := normalize(name)
+			if other, ok := named[[2]string{bucket, to}]; ok {
+				rows.Close()
+				return fmt.Errorf("keys %q and %q of bucket %s are the same once normalized", other, name, bucket)
+			}
+			named[[2]string{bucket, to}] = name
+			if to != key {
+				renames = append(renames, rename{bucket, key, to})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range renames {
+			if err := s.rekey(ctx, tx, "kv_store", "key_norm", "0", r.bucket, r.from, r.to); err != nil {
+				return err
+			}
+			if err := s.rekey(ctx, tx, "kv_history", "key", "version", r.bucket, r.from, r.to); err != nil {
+				return err
+			}
+		}
+		renamed += int64(len(renames))
+
+		// Lists don't keep the names they were created with, so they can
+		// only be normalized further
+		query = "SELECT DISTINCT bucket, key FROM kv_lists"
+		rows, err = tx.QueryContext(ctx, s.q(query))
+		if err != nil {
+			return err
+		}
+		renames = renames[:0]
+		lists := map[[2]string]bool{}
+		for rows.Next() {
+			var bucket, key string
+			if err := rows.Scan(&bucket, &key); err != nil {
+				rows.Close()
+				return err
+			}
+			lists[[2]string{bucket, key}] = true
+			if to := normalize(key); to != key {
+				renames = append(renames, rename{bucket, key, to})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, r := range renames {
+			if lists[[2]string{r.bucket, r.to}] {
+				return fmt.Errorf("lists %q and %q of bucket %s are the same once normalized", r.to, r.from, r.bucket)
+			}
+			lists[[2]string{r.bucket, r.to}] = true
+			if err := s.rekey(ctx, tx, "kv_lists", "key", "idx", r.bucket, r.from, r.to); err != nil {
+				return err
+			}
+		}
+		renamed += int64(len(renames))
+		return nil
+	})
+	return renamed, err
+}
+
+// rekey moves the rows of table stored at key from to key to within tx.
+// Encrypted values are bound to their key, so they are encrypted again. id
+// is the column that tells a key's rows apart, or a constant if a key has only
+// one row.
+func (s *sqlStore) rekey(ctx context.Context, tx *sql.Tx, table, keyCol, id, bucket, from, to string) error {
+	type row struct {
+		id     int64
+		stored []byte
+		flags  int64
+	}
+	var found []row
+	query := "SELECT " + id + ", value, value_flags FROM " + table + " WHERE bucket = ? AND " + keyCol + " = ?"
+	rows, err := tx.QueryContext(ctx, s.q(query), bucket, from)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.stored, &r.flags); err != nil {
+			rows.Close()
+			return err
+		}
+		found = append(found, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range found {
+		if r.flags&valueEncrypted != 0 {
+			value, err := s.codec.decode(bucket, from, r.stored, r.flags)
+			if err != nil {
+				return err
+			}
+			if r.stored, r.flags, err = s.codec.encode(bucket, to, value); err != nil {
+				return err
+			}
+		}
+		query := "UPDATE " + table + " SET " + keyCol + " = ?, value = ?, value_flags = ? WHERE bucket = ? AND " + keyCol + " = ? AND " + id + " = ?"
+		if _, err := tx.ExecContext(ctx, s.q(query), to, r.stored, r.flags, bucket, from, r.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOrphanHistory removes the history of keys that have been removed for
+// good, as the history of a key goes along with it.
+func dropOrphanHistory(ctx context.Context, tx *sql.Tx) error {
+	query := `DELETE FROM kv_history WHERE NOT EXISTS
+		(SELECT 1 FROM kv_store WHERE kv_store.bucket = kv_history.bucket AND kv_store.key_norm = kv_history.key)`
+	_, err := tx.ExecContext(ctx, query)
+	return err
+}
+
+func (s *sqlStore) List(ctx context.Context, bucket string, opts ListOptions) ([]string, error) {
+	infos, err := s.ListInfo(ctx, bucket, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Always return a non-nil slice so an empty bucket encodes as []
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		keys = append(keys, info.Key)
+	}
+	return keys, nil
+}
+
+func (s *sqlStore) ListInfo(ctx context.Context, bucket string, opts ListOptions) ([]KeyInfo, error) {
+	// Keys are listed under the names they were written with, but matched
+	// and ordered by the keys they are looked up by
+	query := "SELECT key, " + s.sizeCol() + ", updated_at FROM kv_store WHERE bucket = ? AND " + liveCond
+	args := []any{bucket, time.Now().Unix()}
+	if opts.Prefix != "" {
+		query += ` AND key_norm LIKE ? ESCAPE '\'`
+		args = append(args, escapeLike(opts.Prefix)+"%")
+	}
+	if opts.After != "" {
+		query += " AND key_norm > ?"
+		args = append(args, opts.After)
+	}
+	query += " ORDER BY key_norm LIMIT ?"
+	args = append(args, opts.Limit)
+
+	rows, err := s.db.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	infos := []KeyInfo{}
+	for rows.Next() {
+		var info KeyInfo
+		var updatedAt sql.NullInt64
+		if err := rows.Scan(&info.Key, &info.Size, &updatedAt); err != nil {
+			return nil, err
+		}
+		info.UpdatedAt = unixTime(updatedAt)
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
+
+func (s *sqlStore) Count(ctx context.Context, bucket, prefix string) (int64, error) {
+	query := "SELECT COUNT(*) FROM kv_store WHERE bucket = ? AND " + liveCond
+	args := []any{bucket, time.Now().Unix()}
+	if prefix != "" {
+		query += ` AND key_norm LIKE ? ESCAPE '\'`
+		args = append(args, escapeLike(prefix)+"%")
+	}
+
+	var count int64
+	err := s.db.QueryRowContext(ctx, s.q(query), args...).Scan(&count)
+	return count, err
+}
+
+// escapeLike escapes the LIKE wildcards in s so it matches literally.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// placeholders returns n comma-separated SQL bind placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func (s *sqlStore) Exists(ctx context.Context, bucket string, keys []string) (map[string]bool, error) {
+	exists := make(map[string]bool, len(keys))
+	if len(keys) == 0 {
+		return exists, nil
+	}
+
+	args := []any{bucket, time.Now().Unix()}
+	for _, key := range keys {
+		exists[key] = false
+		args = append(args, key)
+	}
+	query := "SELECT key_norm FROM kv_store WHERE bucket = ? AND " + liveCond + " AND key_norm IN (" + placeholders(len(keys)) + ")"
+
+	rows, err := s.db.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		exists[key] = true
+	}
+	return exists, rows.Err()
+}
+
+func (s *sqlStore) GetMany(ctx context.Context, bucket string, keys []string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+
+	args := []any{bucket, time.Now().Unix()}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	query := "SELECT key_norm, value, value_flags FROM kv_store WHERE bucket = ? AND " + liveCond + " AND key_norm IN (" + placeholders(len(keys)) + ")"
+
+	rows, err := s.db.QueryContext(ctx, s.q(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		var flags int64
+		if err := rows.Scan(&key, &value, &flags); err != nil {
+			return nil, err
+		}
+		if values[key], err = s.codec.decode(bucket, key, value, flags); err != nil {
+			return nil, err
+		}
+	}
+	return values, rows.Err()
+}
+
+func (s *sqlStore) PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) error {
+	_, err := s.Import(ctx, bucket, entries, true, limits)
+	return err
+}
+
+func (s *sqlStore) Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) ([]string, error) {
+	var written []string
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+
+		sizes := make(map[string]int64, len(entries))
+		for key, entry := range entries {
+			if !overwrite {
+				exists, err := s.keyExists(ctx, tx, bucket, key, now)
+				if err != nil {
+					return err
+				}
+				if exists {
+					continue
+				}
+			}
+			sizes[key] = int64(len(entry.Value))
+		}
+		if len(sizes) == 0 {
+			return nil
+		}
+		if err := s.checkQuota(ctx, tx, bucket, limits, sizes, now); err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(sizes))
+		for key := range sizes {
+			if err := s.upsert(ctx, tx, bucket, key, entries[key], now); err != nil {
+				return err
+			}
+			if err := s.audit(ctx, tx, bucket, key, auditPut, sizes[key], now); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		written = keys
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return written, nil
+}
+
+func (s *sqlStore) Export(ctx context.Context, bucket string, fn func(key string, value []byte) error) error {
+	query := "SELECT key, key_norm, value, value_flags FROM kv_store WHERE bucket = ? AND " + liveCond + " ORDER BY key_norm"
+	rows, err := s.db.QueryContext(ctx, s.q(query), bucket, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, keyNorm string
+		var value []byte
+		var flags int64
+		if err := rows.Scan(&key, &keyNorm, &value, &flags); err != nil {
+			return err
+		}
+		if value, err = s.codec.decode(bucket, keyNorm, value, flags); err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (*Entry, error) {
+	var updated *Entry
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+
+		var current *Entry
+		var value []byte
+		var flags int64
+		var contentType, metadata sql.NullString
+		var expiresAt, createdAt, updatedAt sql.NullInt64
+		query := "SELECT value, value_flags, content_type, metadata, expires_at, created_at, updated_at FROM kv_store WHERE bucket = ? AND key_norm = ? AND " + liveCond
+		err := tx.QueryRowContext(ctx, s.q(query), bucket, key, now).Scan(&value, &flags, &contentType, &metadata, &expiresAt, &createdAt, &updatedAt)
+		switch {
+		case err == nil:
+			if value, err = s.codec.decode(bucket, key, value, flags); err != nil {
+				return err
+			}
+			current = &Entry{
+				Value:       value,
+				Size:        int64(len(value)),
+				ContentType: contentType.String,
+				Metadata:    metadata.String,
+				ExpiresAt:   unixTime(expiresAt),
+				CreatedAt:   unixTime(createdAt),
+				UpdatedAt:   unixTime(updatedAt),
+			}
+		case err != sql.ErrNoRows:
+			return err
+		}
+
+		entry, err := fn(current)
+		if err != nil {
+			return err
+		}
+		if err := s.checkQuota(ctx, tx, bucket, limits, map[string]int64{key: int64(len(entry.Value))}, now); err != nil {
+			return err
+		}
+		if err := s.upsert(ctx, tx, bucket, key, entry, now); err != nil {
+			return err
+		}
+		if err := s.audit(ctx, tx, bucket, key, auditPut, int64(len(entry.Value)), now); err != nil {
+			return err
+		}
+		updated = entry
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+func (s *sqlStore) Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (int64, error) {
+	var value int64
+	_, err := s.Update(ctx, bucket, key, limits, increment(delta, &value))
+	return value, err
+}
+
+// increment returns an Update function that adds delta to an integer value,
+// or starts it at delta, and stores the result in value.
+func increment(delta int64, value *int64) func(current *Entry) (*Entry, error) {
+	return func(current *Entry) (*Entry, error) {
+		if current == nil {
+			*value = delta
+			return &Entry{Value: []byte(strconv.FormatInt(delta, 10)), ContentType: "text/plain; charset=utf-8"}, nil
+		}
+
+		n, err := strconv.ParseInt(string(current.Value), 10, 64)
+		if err != nil {
+			return nil, errNotInteger
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return nil, errOverflow
+		}
+		*value = n + delta
+
+		// Keep any existing TTL; incrementing does not extend a key's life
+		current.Value = []byte(strconv.FormatInt(*value, 10))
+		return current, nil
+	}
+}
+
+func (s *sqlStore) Push(ctx context.Context, bucket, key string, value []byte, limits Limits) (int64, error) {
+	stored, flags, err := s.codec.encode(bucket, key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	var length int64
+	err = s.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now().Unix()
+		if limits.MaxBytes > 0 {
+			used, err := s.usedBytes(ctx, tx, bucket, nil, now)
+			if err != nil {
+				return err
+			}
+			if used+int64(len(value)) > limits.MaxBytes {
+				return errQuotaExceeded
+			}
+		}
+
+		var last sql.NullInt64
+		query := "SELECT MAX(idx), COUNT(*) FROM kv_lists WHERE bucket = ? AND key = ?"
+		if err := tx.QueryRowContext(ctx, s.q(query), bucket, key).Scan(&last, &length); err != nil {
+			return err
+		}
+		if length == 0 {
+			// A new list is a new key
+			if err := s.checkKeyLimit(ctx, tx, bucket, limits, nil, 1, now); err != nil {
+				return err
+			}
+		}
+		query = "INSERT INTO kv_lists (bucket, key, idx, value, value_size, value_flags) VALUES (?, ?, ?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, s.q(query), bucket, key, last.Int64+1, stored, len(value), flags); err != nil {
+			return err
+		}
+		length++
+		return s.audit(ctx, tx, bucket, key, auditPush, int64(len(value)), now)
+	})
+	return length, err
+}
+
+func (s *sqlStore) Items(ctx context.Context, bucket, key string) ([][]byte, error) {
+	query := "SELECT value, value_flags FROM kv_lists WHERE bucket = ? AND key = ? ORDER BY idx"
+	rows, err := s.db.QueryContext(ctx, s.q(query), bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := [][]byte{}
+	for rows.Next() {
+		var stored []byte
+		var flags int64
+		if err := rows.Scan(&stored, &flags); err != nil {
+			return nil, err
+		}
+		value, err := s.codec.decode(bucket, key, stored, flags)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, value)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqlStore) Pop(ctx context.Context, bucket, key string) ([]byte, error) {
+	var value []byte
+	err := s.withTx(ctx, func(tx *sql.Tx) error {
+		var idx, flags int64
+		var stored []byte
+		query := "SELECT idx, value, value_flags FROM kv_lists WHERE bucket = ? AND key = ? ORDER BY idx DESC LIMIT 1"
+		err := tx.QueryRowContext(ctx, s.q(query), bucket, key).Scan(&idx, &stored, &flags)
+		if err == sql.ErrNoRows {
+			return errNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if value, err = s.codec.decode(bucket, key, stored, flags); err != nil {
+			return err
+		}
+
+		query = "DELETE FROM kv_lists WHERE bucket = ? AND key = ? AND idx = ?"
+		if _, err := tx.ExecContext(ctx, s.q(query), bucket, key, idx); err != nil {
+			return err
+		}
+		return s.audit(ctx, tx, bucket, key, auditPop, int64(len(value)), time.Now().Unix())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// Store is the storage backend behind the HTTP API. Handlers depend only on
+// this interface so the backing database can be swapped.
+type Store interface {
+	// Ping checks that the backend is reachable.
+	Ping(ctx context.Context) error
+	// SchemaVersion returns the version of the database schema.
+	SchemaVersion() int
+	// Close releases the backend's resources.
+	Close() error
+	// Backup writes a consistent snapshot of the whole database to w.
+	Backup(ctx context.Context, w io.Writer) error
+	// Vacuum rebuilds the database to reclaim the space of deleted data.
+	Vacuum(ctx context.Context) error
+	// Size returns the size of the database in bytes.
+	Size(ctx context.Context) (int64, error)
+	// Stats returns totals across all buckets and the state of the
+	// connection pool.
+	Stats(ctx context.Context) (*Stats, error)
+
+	// CreateBucket creates a bucket for email along with its first token. The
+	// bucket's ID is random, after idPrefix. With a non-empty verifyCode, the
+	// bucket stays unverified until VerifyBucket is called with that code.
+	CreateBucket(ctx context.Context, email, idPrefix string, limits Limits, verifyCode string) (bucketID, token string, err error)
+	// VerifyBucket marks the bucket a token belongs to as verified if code
+	// matches, returning errInvalidCode if not. Verifying a bucket again is a
+	// no-op.
+	VerifyBucket(ctx context.Context, token, code string) error
+	// DeleteBucket removes a bucket along with its tokens and keys.
+	DeleteBucket(ctx context.Context, bucketID string) error
+	// ValidateToken resolves a token to the bucket it grants access to.
+	ValidateToken(ctx context.Context, token string) (*Auth, error)
+	// CreateToken mints an additional token with the given scope.
+	CreateToken(ctx context.Context, bucketID, scope string) (string, error)
+	// RotateToken replaces a token with a new one of the same scope.
+	RotateToken(ctx context.Context, token string) (string, error)
+	// RevokeToken deletes one of a bucket's tokens. It returns errLastToken
+	// rather than leave the bucket without any.
+	RevokeToken(ctx context.Context, bucketID, token string) error
+	// SetWebhook sets the URL notified of a bucket's changes and the secret
+	// used to sign notifications. An empty url removes the webhook.
+	SetWebhook(ctx context.Context, bucketID, url, secret string) error
+	// SetSchema sets the JSON Schema that values written to a bucket must
+	// match. An empty schema removes it.
+	SetSchema(ctx context.Context, bucketID, schema string) error
+	// SetFrozen freezes or unfreezes a bucket. Returns errNotFound if the
+	// bucket doesn't exist.
+	SetFrozen(ctx context.Context, bucketID string, frozen bool) error
+	// SetRateLimit overrides the server's rate limit for a bucket with rps
+	// requests per second. Zero reverts to the server's limit. Returns
+	// errNotFound if the bucket doesn't exist.
+	SetRateLimit(ctx context.Context, bucketID string, rps float64) error
+	// Webhook returns a bucket's webhook URL and secret, or errNotFound if it
+	// has none.
+	Webhook(ctx context.Context, bucketID string) (url, secret string, err error)
+	// Audit returns the audit log entries matching query, oldest first.
+	Audit(ctx context.Context, query AuditQuery) ([]AuditRecord, error)
+	// CountBuckets returns the number of buckets.
+	CountBuckets(ctx context.Context) (int64, error)
+	// ListBuckets returns up to limit buckets with IDs after after, in ID
+	// order, along with their usage.
+	ListBuckets(ctx context.Context, after string, limit int) ([]BucketInfo, error)
+
+	// Get returns the entry stored at key, including its value.
+	Get(ctx context.Context, bucket, key string) (*Entry, error)
+	// GetRange returns the entry stored at key with only part of its value.
+	// resolve is given the size of the value and returns the offset and length
+	// of the part to read; an error from resolve is returned as is. The offset
+	// is returned along with the entry, whose Size is that of the whole value.
+	GetRange(ctx context.Context, bucket, key string, resolve func(size int64) (offset, length int64, err error)) (*Entry, int64, error)
+	// Open returns the entry stored at key without its value, and a reader
+	// for the value, so values kept in files can be streamed rather than
+	// read into memory. The entry's ETag is set. The caller must close the
+	// reader.
+	Open(ctx context.Context, bucket, key string) (*Entry, io.ReadCloser, error)
+	// Stat returns the entry stored at key without its value.
+	Stat(ctx context.Context, bucket, key string) (*Entry, error)
+	// RecordAccess counts a read of key.
+	RecordAccess(ctx context.Context, bucket, key string) error
+	// SetMetadata replaces the metadata of the entry stored at key, leaving
+	// its value alone. Returns errNotFound if the key doesn't exist.
+	SetMetadata(ctx context.Context, bucket, key, metadata string) error
+	// Touch makes the entry stored at key expire at expiresAt instead, leaving
+	// its value alone. It returns errNotFound if the key doesn't exist or has
+	// already expired.
+	Touch(ctx context.Context, bucket, key string, expiresAt time.Time) error
+	// WriteBlob stores the value read from r in a file as it is, without
+	// holding it in memory, and returns the file's name and the value's
+	// size, for a Put of an Entry with that Blob. It returns errNoBlobDir if
+	// values aren't kept in files.
+	WriteBlob(ctx context.Context, bucket string, r io.Reader) (name string, size int64, err error)
+	// Put creates or replaces the entry stored at key and reports whether it
+	// created the key, as opposed to replacing a live entry.
+	Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (created bool, err error)
+	// Delete moves the entry stored at key to the trash.
+	Delete(ctx context.Context, bucket, key string) error
+	// DeleteIfMatch moves the entry stored at key to the trash only if its
+	// ETag matches ifMatch, returning errPreconditionFailed if not.
+	DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) error
+	// Release permanently removes the lock stored at key if its value is
+	// token, returning errPreconditionFailed if not. Unlike a deleted entry,
+	// a released lock can't be restored, since that would hand its token
+	// back out.
+	Release(ctx context.Context, bucket, key, token string) error
+	// DeletePrefix moves every entry whose key starts with prefix to the trash
+	// and returns how many were moved.
+	DeletePrefix(ctx context.Context, bucket, prefix string) (int64, error)
+	// DeleteMany atomically moves those of keys that exist to the trash and
+	// returns them.
+	DeleteMany(ctx context.Context, bucket string, keys []string) ([]string, error)
+	// Restore brings back an entry that was moved to the trash after
+	// deletedSince and returns it, or errNotFound if there is none.
+	Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (*Entry, error)
+	// Purge permanently removes entries moved to the trash before
+	// deletedBefore and returns how many were removed.
+	Purge(ctx context.Context, deletedBefore time.Time) (int64, error)
+	// DeleteExpired permanently removes entries that expired by now and
+	// returns how many were removed. Entries in the trash are left to Purge.
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+	// PurgeBlobs deletes the files of values that no entry or version refers
+	// to any more and that were written before writtenBefore, and returns how
+	// many were deleted.
+	PurgeBlobs(ctx context.Context, writtenBefore time.Time) (int64, error)
+	// NormalizeKeys re-derives the keys entries are looked up by from the
+	// names they were written under, for when normalization has been
+	// turned on or off, and returns how many keys changed. It fails,
+	// changing nothing, if two names become the same key.
+	NormalizeKeys(ctx context.Context, normalize func(name string) string) (int64, error)
+	// List returns key names in key order.
+	List(ctx context.Context, bucket string, opts ListOptions) ([]string, error)
+	// ListInfo is like List but describes each key along with its name.
+	ListInfo(ctx context.Context, bucket string, opts ListOptions) ([]KeyInfo, error)
+	// Count returns the number of keys, optionally only those with a prefix.
+	Count(ctx context.Context, bucket, prefix string) (int64, error)
+	// History returns the previous versions of key, newest first.
+	History(ctx context.Context, bucket, key string) ([]Version, error)
+	// GetVersion returns a previous version of key, or errNotFound if there
+	// is no such version.
+	GetVersion(ctx context.Context, bucket, key string, version int64) (*Entry, error)
+	// Revert makes a previous version of key its current value, keeping the
+	// value it replaces as a new version, and returns the new entry. It
+	// returns errNotFound if there is no such version.
+	Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (*Entry, error)
+	// Exists reports for each of keys whether it exists.
+	Exists(ctx context.Context, bucket string, keys []string) (map[string]bool, error)
+	// GetMany returns the values of those keys that exist.
+	GetMany(ctx context.Context, bucket string, keys []string) (map[string][]byte, error)
+	// PutMany writes several entries atomically.
+	PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) error
+	// Import writes several entries atomically, like PutMany. Unless overwrite
+	// is set, keys that already exist are left alone. It returns the keys that
+	// were written.
+	Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) ([]string, error)
+	// Export calls fn with every key and value in key order, streaming them
+	// from the database. It stops at the first error fn returns.
+	Export(ctx context.Context, bucket string, fn func(key string, value []byte) error) error
+	// Update atomically replaces the entry stored at key with the one fn
+	// returns. fn is given the current entry, or nil if the key doesn't exist,
+	// and may be called more than once. An error from fn aborts the update and
+	// is returned as is.
+	Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (*Entry, error)
+	// Incr adds delta to the integer stored at key and returns the result.
+	Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (int64, error)
+
+	// Lists are kept apart from values, so a key can name both a value and a
+	// list.
+
+	// Push appends value to the end of the list at key, creating the list if
+	// needed, and returns its new length.
+	Push(ctx context.Context, bucket, key string, value []byte, limits Limits) (int64, error)
+	// Items returns the elements of the list at key, first to last. A list
+	// that doesn't exist is empty.
+	Items(ctx context.Context, bucket, key string) ([][]byte, error)
+	// Pop removes and returns the last element of the list at key, or
+	// errNotFound if the list is empty.
+	Pop(ctx context.Context, bucket, key string) ([]byte, error)
+}
+
+// Errors returned by Store implementations.
+var (
+	errNotFound           = errors.New("not found")
+	errEmailInUse         = errors.New("email address already in use")
+	errBucketExists       = errors.New("bucket already exists")
+	errKeyExists          = errors.New("key already exists")
+	errPreconditionFailed = errors.New("precondition failed")
+	errQuotaExceeded      = errors.New("storage quota exceeded")
+	errKeyLimitExceeded   = errors.New("key limit exceeded")
+	errNotInteger         = errors.New("value is not an integer")
+	errOverflow           = errors.New("integer overflow")
+	errNotSupported       = errors.New("not supported by this backend")
+	errIdempotencyReused  = errors.New("idempotency key reused with a different request")
+	errInvalidCode        = errors.New("invalid verification code")
+	errBusy               = errors.New("database busy")
+	errLastToken          = errors.New("last token of the bucket")
+)
+
+// replayedError is returned instead of repeating a write that was already made
+// with the same idempotency key. Status is the one recorded for the original.
+type replayedError struct {
+	Status int
+}
+
+func (e *replayedError) Error() string {
+	return "request already processed"
+}
+
+// staleWriteError is returned when a last-write-wins write is older than the
+// value already stored. Current is the write timestamp of the stored value.
+type staleWriteError struct {
+	Current time.Time
+}
+
+func (e *staleWriteError) Error() string {
+	return "a newer write exists"
+}
+
+// Auth describes what a token grants access to.
+type Auth struct {
+	BucketID string
+	Scope    string
+	Limits   Limits
+	// Verified is false until the owner of a bucket created with a
+	// verification code has confirmed their email address.
+	Verified bool
+	// Schema is the JSON Schema values written to the bucket must match, or
+	// empty if there is none.
+	Schema string
+	// Frozen is true while the bucket is frozen for maintenance and no keys
+	// may be written.
+	Frozen bool
+	// RateLimit is the bucket's own limit in requests per second, or zero if
+	// the server's limit applies.
+	RateLimit float64
+}
+
+// Audited operations.
+const (
+	auditPut          = "put"
+	auditDelete       = "delete"
+	auditRestore      = "restore"
+	auditRevert       = "revert"
+	auditPush         = "push"
+	auditPop          = "pop"
+	auditCreateBucket = "create_bucket"
+	auditDeleteBucket = "delete_bucket"
+)
+
+// AuditRecord is an entry in the audit log. Every change to a key is recorded
+// along with the size of the value written or deleted, but never the value.
+type AuditRecord struct {
+	ID        int64     `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Size      int64     `json:"size"`
+	Time      time.Time `json:"time"`
+}
+
+// AuditQuery selects a page of the audit log. Empty fields match everything.
+type AuditQuery struct {
+	Bucket string
+	Since  time.Time
+	Until  time.Time
+	After  int64
+	Limit  int
+}
+
+// BucketInfo summarizes a bucket for administrators.
+type BucketInfo struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+	Keys  int64  `json:"keys"`
+	Bytes int64  `json:"bytes"`
+	// Frozen is true while no keys may be written.
+	Frozen bool `json:"frozen"`
+	// RateLimit overrides the server's rate limit if set.
+	RateLimit *float64 `json:"rate_limit"`
+}
+
+// Stats describes the whole store.
+type Stats struct {
+	Buckets       int64 `json:"buckets"`
+	Keys          int64 `json:"keys"`
+	Bytes         int64 `json:"bytes"`
+	DatabaseBytes int64 `json:"database_bytes"`
+	// TxRetries counts the transactions retried because they conflicted or
+	// found the database locked since the server started.
+	TxRetries int64     `json:"tx_retries"`
+	Pool      PoolStats `json:"pool"`
+}
+
+// PoolStats describes the database connection pool.
+type PoolStats struct {
+	MaxOpen      int   `json:"max_open"`
+	Open         int   `json:"open"`
+	InUse        int   `json:"in_use"`
+	Idle         int   `json:"idle"`
+	WaitCount    int64 `json:"wait_count"`
+	WaitMillis   int64 `json:"wait_ms"`
+	ClosedIdle   int64 `json:"closed_max_idle"`
+	ClosedExpiry int64 `json:"closed_max_lifetime"`
+}
+
+// Limits holds a bucket's quotas. Zero means unlimited.
+type Limits struct {
+	MaxBytes int64
+	// MaxKeys caps the number of keys, counting neither expired keys nor
+	// those in the trash.
+	MaxKeys int64
+}
+
+// Entry is a stored value and its metadata. Zero times mean unknown, or for
+// ExpiresAt, that the entry never expires.
+type Entry struct {
+	// Key is the name the entry is written under when keys are
+	// normalized. An entry written without one keeps its current name, or
+	// is named by its key if it is new.
+	Key   string
+	Value []byte
+	// Blob names the file written by WriteBlob that holds the value of an
+	// entry being written, in which case Value is empty and Size is the
+	// value's size.
+	Blob        string
+	Size        int64
+	ContentType string
+	// Metadata is JSON attached to the entry by the client, or empty if
+	// there is none.
+	Metadata  string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// WriteTime orders writes for last-write-wins. It defaults to the time
+	// the value is stored.
+	WriteTime time.Time
+	// AccessCount and LastAccessedAt track reads, if enabled. They are only
+	// filled in by Stat.
+	AccessCount    int64
+	LastAccessedAt time.Time
+	// ETag is the entity tag of the value. It is only filled in by Open.
+	ETag string
+}
+
+// valueSize returns the size of the value of an entry being written.
+func (e *Entry) valueSize() int64 {
+	if e.Blob != "" {
+		return e.Size
+	}
+	return int64(len(e.Value))
+}
+
+// KeyInfo describes a key in a listing.
+type KeyInfo struct {
+	Key       string    `json:"key"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Version describes a previous value of a key.
+type Version struct {
+	Version     int64  `json:"version"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+	// UpdatedAt is when the value was written and ReplacedAt when it was
+	// overwritten.
+	UpdatedAt  time.Time `json:"updated_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+// PutOptions holds the preconditions and limits for a write.
+type PutOptions struct {
+	// IfMatch only allows the write if the current ETag matches.
+	IfMatch string
+	// IfNoneMatch only allows the write if the key does not exist.
+	IfNoneMatch bool
+	// LastWriteWins only allows the write if the entry's WriteTime is later
+	// than that of the stored value.
+	LastWriteWins bool
+	Limits        Limits
+	// DryRun runs every check without writing anything.
+	DryRun bool
+	// Idempotency, if set, makes retries of the write harmless.
+	Idempotency *Idempotency
+}
+
+// Idempotency identifies a write that clients may retry. A repeat of a
+// successful write with the same key within TTL is not carried out again.
+type Idempotency struct {
+	Key string
+	// Fingerprint identifies the request, so reusing a key for a different
+	// request can be caught.
+	Fingerprint string
+	// Status is recorded with the key and reported for replays, or
+	// UpdatedStatus instead if the write replaced an existing entry.
+	Status        int
+	UpdatedStatus int
+	TTL           time.Duration
+}
+
+// ListOptions selects a page of keys.
+type ListOptions struct {
+	Prefix string
+	After  string
+	Limit  int
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// slowHeaderTimeout is how long a client may take to send a request's headers.
+const slowHeaderTimeout = 10 * time.Second
+
+// timeoutMessage is the body of a response to a request that ran out of time.
+const timeoutMessage = `{"error":"Request timed out"}`
+
+// timeoutMiddleware gives each request a deadline of timeout, after which its
+// database queries are cancelled. A request whose handler fails because the
+// deadline passed gets 503 instead of the handler's error. Routes in exempt,
+// such as streams that are meant to stay open, get no deadline.
+func timeoutMiddleware(timeout time.Duration, exempt ...string) gin.HandlerFunc {
+	skip := map[string]bool{}
+	for _, route := range exempt {
+		skip[route] = true
+	}
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		w := &timeoutResponseWriter{ResponseWriter: c.Writer, ctx: ctx}
+		c.Writer = w
+		defer func() {
+			c.Writer = w.ResponseWriter
+		}()
+
+		c.Next()
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for routes in exempt,
+// such as streams that are meant to stay open and downloads of the whole
+// database. It must run before any middleware that wraps the response writer.
+func clearWriteDeadline(exempt ...string) gin.HandlerFunc {
+	skip := map[string]bool{}
+	for _, route := range exempt {
+		skip[route] = true
+	}
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+				slog.WarnContext(c.Request.Context(), "Error clearing write deadline", "route", c.FullPath(), "error", err)
+			}
+		}
+		c.Next()
+	}
+}
+
+// timeoutResponseWriter turns a server error written after the request's
+// deadline has passed into 503 with timeoutMessage as its body.
+type timeoutResponseWriter struct {
+	gin.ResponseWriter
+	ctx      context.Context
+	timedOut bool
+	wrote    bool
+}
+
+func (w *timeoutResponseWriter) WriteHeader(code int) {
+	if code >= http.StatusInternalServerError && errors.Is(w.ctx.Err(), context.DeadlineExceeded) {
+		w.timedOut = true
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		code = http.StatusServiceUnavailable
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timeoutResponseWriter) Write(b []byte) (int, error) {
+	if !w.timedOut {
+		return w.ResponseWriter.Write(b)
+	}
+	// Replace the handler's body, which describes the failed query
+	if !w.wrote {
+		w.wrote = true
+		if _, err := w.ResponseWriter.WriteString(timeoutMessage); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *timeoutResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// tlsOptions selects how the server terminates TLS: with a certificate and key
+// from disk, with certificates obtained automatically from Let's Encrypt, or
+// not at all.
+type tlsOptions struct {
+	CertFile string
+	KeyFile  string
+
+	Auto     bool
+	Domains  []string
+	CacheDir string
+}
+
+// validate checks that the options describe exactly one way of serving.
+func (o tlsOptions) validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if o.Auto {
+		if o.CertFile != "" {
+			return errors.New("-tls-auto can't be combined with -tls-cert and -tls-key")
+		}
+		if len(o.Domains) == 0 {
+			return errors.New("-tls-auto requires -domain")
+		}
+	}
+	return nil
+}
+
+// mode describes how the server is served, for logging.
+func (o tlsOptions) mode() string {
+	switch {
+	case o.Auto:
+		return "auto"
+	case o.CertFile != "":
+		return "files"
+	default:
+		return "off"
+	}
+}
+
+// listenAndServe starts srv with the configured TLS mode. Automatic
+// certificates are obtained with the TLS-ALPN-01 challenge, so the server must
+// be reachable on port 443 for the listed domains. Clients may use HTTP/2
+// over TLS; plain HTTP is only served as HTTP/1.1.
+func (o tlsOptions) listenAndServe(srv *http.Server) error {
+	if o.Auto || o.CertFile != "" {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		srv.Protocols = &protocols
+	}
+
+	switch {
+	case o.Auto:
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(o.Domains...),
+			Cache:      autocert.DirCache(o.CacheDir),
+		}
+		srv.TLSConfig = m.TLSConfig()
+		return srv.ListenAndServeTLS("", "")
+	case o.CertFile != "":
+		return srv.ListenAndServeTLS(o.CertFile, o.KeyFile)
+	default:
+		return srv.ListenAndServe()
+	}
+}
+
+// grpcOptions returns the options that make the gRPC server use the
+// configured certificate and key. Automatic certificates are not supported
+// for gRPC.
+func (o tlsOptions) grpcOptions() ([]grpc.ServerOption, error) {
+	if o.CertFile == "" {
+		return nil, nil
+	}
+	creds, err := credentials.NewServerTLSFromFile(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
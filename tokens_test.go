@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTokenRouter returns a router managing the tokens of the buckets of store
+// and serving their keys, with the middleware main installs.
+func newTokenRouter(store Store) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	account := router.Group("/bucket", authMiddleware(store))
+	account.POST("/rotate", rotateTokenHandler(store))
+	account.POST("/tokens", requireWriteScope(), createTokenHandler(store))
+	account.DELETE("/tokens/:token", requireWriteScope(), revokeTokenHandler(store))
+	api := router.Group("/kv", authMiddleware(store))
+	api.GET("/:key", getHandler(store, false))
+	api.POST("/:key", requireWriteScope(), putHandler(store, newSchemaCache(), 1<<20, 0, 0))
+	return router
+}
+
+// newTokenTest returns a router and a bucket's first, read-write, token.
+func newTokenTest(t *testing.T) (*gin.Engine, string) {
+	t.Helper()
+	store := newTestStore(t, storeOptions{})
+	_, token, err := store.CreateBucket(context.Background(), "tokens@example.com", "", Limits{}, "")
+	if err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+	return newTokenRouter(store), token
+}
+
+// tokenFrom returns the token in the body of a response.
+func tokenFrom(t *testing.T, body []byte) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || resp.Token == "" {
+		t.Fatalf("no token in %q", body)
+	}
+	return resp.Token
+}
+
+// TestRotateKeepsScope checks that rotating a read-only token gives another
+// read-only token, rather than a way to gain write access.
+func TestRotateKeepsScope(t *testing.T) {
+	router, owner := newTokenTest(t)
+
+	w := serveAs(router, owner, http.MethodPost, "/bucket/tokens", `{"scope":"ro"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create token status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+	}
+	readOnly := tokenFrom(t, w.Body.Bytes())
+
+	w = serveAs(router, readOnly, http.MethodPost, "/bucket/rotate", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotate status = %d, want %d", w.Code, http.StatusOK)
+	}
+	rotated := tokenFrom(t, w.Body.Bytes())
+
+	if w := serveAs(router, readOnly, http.MethodGet, "/kv/k", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with the old token status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serveAs(router, rotated, http.MethodGet, "/kv/k", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET with the rotated token status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveAs(router, rotated, http.MethodPost, "/kv/k", "v"); w.Code != http.StatusForbidden {
+		t.Errorf("POST with the rotated token status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serveAs(router, rotated, http.MethodPost, "/bucket/tokens", ""); w.Code != http.StatusForbidden {
+		t.Errorf("minting with the rotated token status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	// A read-write token stays read-write
+	w = serveAs(router, owner, http.MethodPost, "/bucket/rotate", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("rotate status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serveAs(router, tokenFrom(t, w.Body.Bytes()), http.MethodPost, "/kv/k", "v"); w.Code != http.StatusCreated {
+		t.Errorf("POST with the rotated owner token status = %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	router, owner := newTokenTest(t)
+
+	if w := serveAs(router, owner, http.MethodDelete, "/bucket/tokens/"+owner, ""); w.Code != http.StatusConflict {
+		t.Fatalf("revoking the last token status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := serveAs(router, owner, http.MethodGet, "/kv/k", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET with the last token status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w := serveAs(router, owner, http.MethodPost, "/bucket/tokens", "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create token status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	other := tokenFrom(t, w.Body.Bytes())
+
+	if w := serveAs(router, owner, http.MethodDelete, "/bucket/tokens/not-a-token", ""); w.Code != http.StatusNotFound {
+		t.Errorf("revoking an unknown token status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := serveAs(router, other, http.MethodDelete, "/bucket/tokens/"+owner, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("revoke status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := serveAs(router, owner, http.MethodGet, "/kv/k", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET with the revoked token status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	// The token left is now the last one
+	if w := serveAs(router, other, http.MethodDelete, "/bucket/tokens/"+other, ""); w.Code != http.StatusConflict {
+		t.Errorf("revoking the new last token status = %d, want %d", w.Code, http.StatusConflict)
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies the spans created by gokv itself.
+const tracerName = "github.com/codingric/gokv"
+
+// bucketAttr is the span attribute holding the bucket a request or database
+// call is for.
+const bucketAttr = attribute.Key("gokv.bucket")
+
+// setupTracing exports traces over OTLP/HTTP to endpoint, e.g.
+// http://localhost:4318, and installs the W3C trace context propagator. The
+// returned function flushes pending spans and must be called on shutdown.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q: must be an http or https URL", endpoint)
+	}
+	// A bare collector address gets the standard path for traces
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(u.String()))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName("gokv")),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// tracingMiddleware starts a server span for every request, continuing the
+// trace of the caller if the request carries a traceparent header.
+func tracingMiddleware() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name += " " + route
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if bucket := c.GetString("bucket"); bucket != "" {
+			span.SetAttributes(bucketAttr.String(bucket))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// tracedStore wraps a Store to record a span around every database call. Spans
+// are children of the request's span, found through the context.
+type tracedStore struct {
+	Store
+	tracer trace.Tracer
+	system attribute.KeyValue
+}
+
+// newTracedStore wraps store; driver is the name of its -driver.
+func newTracedStore(store Store, driver string) tracedStore {
+	system := semconv.DBSystemNameSQLite
+	if driver == "postgres" {
+		system = semconv.DBSystemNamePostgreSQL
+	}
+	return tracedStore{Store: store, tracer: otel.Tracer(tracerName), system: system}
+}
+
+// start begins the span for a call to operation on bucket, which may be empty
+// for calls not tied to one.
+func (s tracedStore) start(ctx context.Context, operation, bucket string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{s.system, semconv.DBOperationNameKey.String(operation)}
+	if bucket != "" {
+		attrs = append(attrs, bucketAttr.String(bucket))
+	}
+	return s.tracer.Start(ctx, "store."+operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// end finishes span, marking it failed if err is an actual failure rather
+// than an expected outcome such as a missing key.
+func end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, errNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s tracedStore) Ping(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "Ping", "")
+	defer func() { end(span, err) }()
+	return s.Store.Ping(ctx)
+}
+
+func (s tracedStore) Backup(ctx context.Context, w io.Writer) (err error) {
+	ctx, span := s.start(ctx, "Backup", "")
+	defer func() { end(span, err) }()
+	return s.Store.Backup(ctx, w)
+}
+
+func (s tracedStore) Vacuum(ctx context.Context) (err error) {
+	ctx, span := s.start(ctx, "Vacuum", "")
+	defer func() { end(span, err) }()
+	return s.Store.Vacuum(ctx)
+}
+
+func (s tracedStore) Size(ctx context.Context) (_ int64, err error) {
+	ctx, span := s.start(ctx, "Size", "")
+	defer func() { end(span, err) }()
+	return s.Store.Size(ctx)
+}
+
+func (s tracedStore) Stats(ctx context.Context) (_ *Stats, err error) {
+	ctx, span := s.start(ctx, "Stats", "")
+	defer func() { end(span, err) }()
+	return s.Store.Stats(ctx)
+}
+
+func (s tracedStore) CreateBucket(ctx context.Context, email, idPrefix string, limits Limits, verifyCode string) (_, _ string, err error) {
+	ctx, span := s.start(ctx, "CreateBucket", "")
+	defer func() { end(span, err) }()
+	return s.Store.CreateBucket(ctx, email, idPrefix, limits, verifyCode)
+}
+
+func (s tracedStore) VerifyBucket(ctx context.Context, token, code string) (err error) {
+	ctx, span := s.start(ctx, "VerifyBucket", "")
+	defer func() { end(span, err) }()
+	return s.Store.VerifyBucket(ctx, token, code)
+}
+
+func (s tracedStore) DeleteBucket(ctx context.Context, bucketID string) (err error) {
+	ctx, span := s.start(ctx, "DeleteBucket", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.DeleteBucket(ctx, bucketID)
+}
+
+func (s tracedStore) ValidateToken(ctx context.Context, token string) (_ *Auth, err error) {
+	ctx, span := s.start(ctx, "ValidateToken", "")
+	defer func() { end(span, err) }()
+	return s.Store.ValidateToken(ctx, token)
+}
+
+func (s tracedStore) CreateToken(ctx context.Context, bucketID, scope string) (_ string, err error) {
+	ctx, span := s.start(ctx, "CreateToken", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.CreateToken(ctx, bucketID, scope)
+}
+
+func (s tracedStore) RotateToken(ctx context.Context, token string) (_ string, err error) {
+	ctx, span := s.start(ctx, "RotateToken", "")
+	defer func() { end(span, err) }()
+	return s.Store.RotateToken(ctx, token)
+}
+
+func (s tracedStore) RevokeToken(ctx context.Context, bucketID, token string) (err error) {
+	ctx, span := s.start(ctx, "RevokeToken", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.RevokeToken(ctx, bucketID, token)
+}
+
+func (s tracedStore) SetWebhook(ctx context.Context, bucketID, url, secret string) (err error) {
+	ctx, span := s.start(ctx, "SetWebhook", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.SetWebhook(ctx, bucketID, url, secret)
+}
+
+func (s tracedStore) SetSchema(ctx context.Context, bucketID, schema string) (err error) {
+	ctx, span := s.start(ctx, "SetSchema", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.SetSchema(ctx, bucketID, schema)
+}
+
+func (s tracedStore) SetFrozen(ctx context.Context, bucketID string, frozen bool) (err error) {
+	ctx, span := s.start(ctx, "SetFrozen", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.SetFrozen(ctx, bucketID, frozen)
+}
+
+func (s tracedStore) SetRateLimit(ctx context.Context, bucketID string, rps float64) (err error) {
+	ctx, span := s.start(ctx, "SetRateLimit", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.SetRateLimit(ctx, bucketID, rps)
+}
+
+func (s tracedStore) Webhook(ctx context.Context, bucketID string) (_, _ string, err error) {
+	ctx, span := s.start(ctx, "Webhook", bucketID)
+	defer func() { end(span, err) }()
+	return s.Store.Webhook(ctx, bucketID)
+}
+
+func (s tracedStore) Audit(ctx context.Context, query AuditQuery) (_ []AuditRecord, err error) {
+	ctx, span := s.start(ctx, "Audit", query.Bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Audit(ctx, query)
+}
+
+func (s tracedStore) CountBuckets(ctx context.Context) (_ int64, err error) {
+	ctx, span := s.start(ctx, "CountBuckets", "")
+	defer func() { end(span, err) }()
+	return s.Store.CountBuckets(ctx)
+}
+
+func (s tracedStore) ListBuckets(ctx context.Context, after string, limit int) (_ []BucketInfo, err error) {
+	ctx, span := s.start(ctx, "ListBuckets", "")
+	defer func() { end(span, err) }()
+	return s.Store.ListBuckets(ctx, after, limit)
+}
+
+func (s tracedStore) Get(ctx context.Context, bucket, key string) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "Get", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Get(ctx, bucket, key)
+}
+
+func (s tracedStore) GetRange(ctx context.Context, bucket, key string, resolve func(size int64) (offset, length int64, err error)) (_ *Entry, _ int64, err error) {
+	ctx, span := s.start(ctx, "GetRange", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.GetRange(ctx, bucket, key, resolve)
+}
+
+func (s tracedStore) Open(ctx context.Context, bucket, key string) (_ *Entry, _ io.ReadCloser, err error) {
+	ctx, span := s.start(ctx, "Open", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Open(ctx, bucket, key)
+}
+
+func (s tracedStore) Stat(ctx context.Context, bucket, key string) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "Stat", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Stat(ctx, bucket, key)
+}
+
+func (s tracedStore) RecordAccess(ctx context.Context, bucket, key string) (err error) {
+	ctx, span := s.start(ctx, "RecordAccess", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.RecordAccess(ctx, bucket, key)
+}
+
+func (s tracedStore) Touch(ctx context.Context, bucket, key string, expiresAt time.Time) (err error) {
+	ctx, span := s.start(ctx, "Touch", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Touch(ctx, bucket, key, expiresAt)
+}
+
+func (s tracedStore) SetMetadata(ctx context.Context, bucket, key, metadata string) (err error) {
+	ctx, span := s.start(ctx, "SetMetadata", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.SetMetadata(ctx, bucket, key, metadata)
+}
+
+func (s tracedStore) WriteBlob(ctx context.Context, bucket string, r io.Reader) (_ string, _ int64, err error) {
+	ctx, span := s.start(ctx, "WriteBlob", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.WriteBlob(ctx, bucket, r)
+}
+
+func (s tracedStore) Put(ctx context.Context, bucket, key string, entry *Entry, opts PutOptions) (created bool, err error) {
+	ctx, span := s.start(ctx, "Put", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Put(ctx, bucket, key, entry, opts)
+}
+
+func (s tracedStore) Delete(ctx context.Context, bucket, key string) (err error) {
+	ctx, span := s.start(ctx, "Delete", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Delete(ctx, bucket, key)
+}
+
+func (s tracedStore) DeleteIfMatch(ctx context.Context, bucket, key, ifMatch string) (err error) {
+	ctx, span := s.start(ctx, "DeleteIfMatch", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.DeleteIfMatch(ctx, bucket, key, ifMatch)
+}
+
+func (s tracedStore) Release(ctx context.Context, bucket, key, token string) (err error) {
+	ctx, span := s.start(ctx, "Release", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Release(ctx, bucket, key, token)
+}
+
+func (s tracedStore) DeletePrefix(ctx context.Context, bucket, prefix string) (_ int64, err error) {
+	ctx, span := s.start(ctx, "DeletePrefix", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.DeletePrefix(ctx, bucket, prefix)
+}
+
+func (s tracedStore) DeleteMany(ctx context.Context, bucket string, keys []string) (_ []string, err error) {
+	ctx, span := s.start(ctx, "DeleteMany", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.DeleteMany(ctx, bucket, keys)
+}
+
+func (s tracedStore) Restore(ctx context.Context, bucket, key string, deletedSince time.Time, limits Limits) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "Restore", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Restore(ctx, bucket, key, deletedSince, limits)
+}
+
+func (s tracedStore) DeleteExpired(ctx context.Context, now time.Time) (_ int64, err error) {
+	ctx, span := s.start(ctx, "DeleteExpired", "")
+	defer func() { end(span, err) }()
+	return s.Store.DeleteExpired(ctx, now)
+}
+
+func (s tracedStore) Purge(ctx context.Context, deletedBefore time.Time) (_ int64, err error) {
+	ctx, span := s.start(ctx, "Purge", "")
+	defer func() { end(span, err) }()
+	return s.Store.Purge(ctx, deletedBefore)
+}
+
+func (s tracedStore) PurgeBlobs(ctx context.Context, writtenBefore time.Time) (_ int64, err error) {
+	ctx, span := s.start(ctx, "PurgeBlobs", "")
+	defer func() { end(span, err) }()
+	return s.Store.PurgeBlobs(ctx, writtenBefore)
+}
+
+func (s tracedStore) List(ctx context.Context, bucket string, opts ListOptions) (_ []string, err error) {
+	ctx, span := s.start(ctx, "List", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.List(ctx, bucket, opts)
+}
+
+func (s tracedStore) ListInfo(ctx context.Context, bucket string, opts ListOptions) (_ []KeyInfo, err error) {
+	ctx, span := s.start(ctx, "ListInfo", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.ListInfo(ctx, bucket, opts)
+}
+
+func (s tracedStore) Count(ctx context.Context, bucket, prefix string) (_ int64, err error) {
+	ctx, span := s.start(ctx, "Count", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Count(ctx, bucket, prefix)
+}
+
+func (s tracedStore) History(ctx context.Context, bucket, key string) (_ []Version, err error) {
+	ctx, span := s.start(ctx, "History", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.History(ctx, bucket, key)
+}
+
+func (s tracedStore) GetVersion(ctx context.Context, bucket, key string, version int64) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "GetVersion", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.GetVersion(ctx, bucket, key, version)
+}
+
+func (s tracedStore) Revert(ctx context.Context, bucket, key string, version int64, limits Limits) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "Revert", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Revert(ctx, bucket, key, version, limits)
+}
+
+func (s tracedStore) Exists(ctx context.Context, bucket string, keys []string) (_ map[string]bool, err error) {
+	ctx, span := s.start(ctx, "Exists", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Exists(ctx, bucket, keys)
+}
+
+func (s tracedStore) GetMany(ctx context.Context, bucket string, keys []string) (_ map[string][]byte, err error) {
+	ctx, span := s.start(ctx, "GetMany", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.GetMany(ctx, bucket, keys)
+}
+
+func (s tracedStore) PutMany(ctx context.Context, bucket string, entries map[string]*Entry, limits Limits) (err error) {
+	ctx, span := s.start(ctx, "PutMany", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.PutMany(ctx, bucket, entries, limits)
+}
+
+func (s tracedStore) Import(ctx context.Context, bucket string, entries map[string]*Entry, overwrite bool, limits Limits) (_ []string, err error) {
+	ctx, span := s.start(ctx, "Import", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Import(ctx, bucket, entries, overwrite, limits)
+}
+
+func (s tracedStore) Export(ctx context.Context, bucket string, fn func(key string, value []byte) error) (err error) {
+	ctx, span := s.start(ctx, "Export", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Export(ctx, bucket, fn)
+}
+
+func (s tracedStore) Update(ctx context.Context, bucket, key string, limits Limits, fn func(current *Entry) (*Entry, error)) (_ *Entry, err error) {
+	ctx, span := s.start(ctx, "Update", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Update(ctx, bucket, key, limits, fn)
+}
+
+func (s tracedStore) Push(ctx context.Context, bucket, key string, value []byte, limits Limits) (_ int64, err error) {
+	ctx, span := s.start(ctx, "Push", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Push(ctx, bucket, key, value, limits)
+}
+
+func (s tracedStore) Items(ctx context.Context, bucket, key string) (_ [][]byte, err error) {
+	ctx, span := s.start(ctx, "Items", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Items(ctx, bucket, key)
+}
+
+func (s tracedStore) Pop(ctx context.Context, bucket, key string) (_ []byte, err error) {
+	ctx, span := s.start(ctx, "Pop", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Pop(ctx, bucket, key)
+}
+
+func (s tracedStore) Incr(ctx context.Context, bucket, key string, delta int64, limits Limits) (_ int64, err error) {
+	ctx, span := s.start(ctx, "Incr", bucket)
+	defer func() { end(span, err) }()
+	return s.Store.Incr(ctx, bucket, key, delta, limits)
+}
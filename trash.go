@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// purgeTrash permanently removes deleted keys once they have been in the trash
+// for longer than retention. It runs until ctx is done.
+func purgeTrash(ctx context.Context, store Store, retention time.Duration) {
+	ticker := time.NewTicker(min(retention, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := store.Purge(ctx, time.Now().Add(-retention))
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Error purging deleted keys", "error", err)
+			}
+			continue
+		}
+		if n > 0 {
+			slog.Info("Purged deleted keys", "count", n)
+		}
+	}
+}
+
+// restoreHandler undeletes a key deleted within the last retention period. It
+// returns 404 if the key isn't in the trash, including when a new value has
+// since been written to it.
+func restoreHandler(store Store, retention time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		_, err := store.Restore(c.Request.Context(), bucket, key, time.Now().Add(-retention), bucketLimits(c))
+		if err != nil {
+			if errors.Is(err, errNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Key not found in trash"})
+				return
+			}
+			if !writeStoreError(c, err) {
+				slog.ErrorContext(c.Request.Context(), "Error restoring key", "key", key, "bucket", bucket, "error", err)
+			}
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
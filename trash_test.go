@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestExpiredKeyStaysInTrash checks that a key with a TTL that is deleted and
+// then expires can be restored until the trash retention is over, rather than
+// being swept away as expired.
+func TestExpiredKeyStaysInTrash(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t, storeOptions{})
+	deletedAt := time.Now()
+
+	for _, key := range []string{"restored", "purged"} {
+		entry := &Entry{Value: []byte(key), ExpiresAt: deletedAt.Add(time.Minute)}
+		if _, err := store.Put(ctx, "b", key, entry, PutOptions{}); err != nil {
+			t.Fatalf("Put %q: %v", key, err)
+		}
+		if err := store.Delete(ctx, "b", key); err != nil {
+			t.Fatalf("Delete %q: %v", key, err)
+		}
+	}
+
+	// Both keys have expired an hour later
+	later := deletedAt.Add(time.Hour)
+	n, err := store.DeleteExpired(ctx, later)
+	if err != nil {
+		t.Fatalf("DeleteExpired: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("DeleteExpired removed %d keys from the trash, want 0", n)
+	}
+
+	entry, err := store.Restore(ctx, "b", "restored", deletedAt.Add(-time.Minute), Limits{})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if string(entry.Value) != "restored" {
+		t.Errorf("Restore value = %q, want %q", entry.Value, "restored")
+	}
+
+	// Once the retention is over, the other key is purged
+	n, err = store.Purge(ctx, later)
+	if err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Purge removed %d keys, want 1", n)
+	}
+	if _, err := store.Restore(ctx, "b", "purged", deletedAt.Add(-time.Minute), Limits{}); err != errNotFound {
+		t.Errorf("Restore of purged key: err = %v, want errNotFound", err)
+	}
+}
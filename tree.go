@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// skipDir returns a cursor that sorts after every key in the directory dir,
+// so listing can resume past it without reading its contents.
+func skipDir(dir string) string {
+	return dir + string(utf8.MaxRune)
+}
+
+// treeHandler lists the immediate children of a prefix, like a directory
+// listing: keys directly under the prefix, and the directories formed by the
+// next path segment of longer keys, each ending in the delimiter. Results are
+// paged like listHandler, counting keys and directories together.
+func treeHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		prefix := c.Query("prefix")
+		delimiter := c.DefaultQuery("delimiter", "/")
+		if delimiter == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "delimiter must not be empty"})
+			return
+		}
+
+		limit := defaultListLimit
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be an integer between 1 and 1000"})
+				return
+			}
+			limit = n
+		}
+
+		// A cursor naming a directory resumes after all of its keys
+		after := c.Query("after")
+		if strings.HasSuffix(after, delimiter) {
+			after = skipDir(after)
+		}
+
+		keys, dirs := []string{}, []string{}
+		var last string
+		for count := 0; count <= limit; {
+			page, err := store.List(c.Request.Context(), bucket, ListOptions{Prefix: prefix, After: after, Limit: limit + 1})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				slog.ErrorContext(c.Request.Context(), "Error listing keys", "bucket", bucket, "error", err)
+				return
+			}
+			if len(page) == 0 {
+				break
+			}
+
+			for _, key := range page {
+				after = key
+				rest := key[len(prefix):]
+				i := strings.Index(rest, delimiter)
+				if i < 0 {
+					keys = append(keys, key)
+					last = key
+					count++
+				} else if dir := prefix + rest[:i+len(delimiter)]; dir != last {
+					dirs = append(dirs, dir)
+					last = dir
+					count++
+					// Skip the rest of the directory with a fresh query
+					after = skipDir(dir)
+					break
+				}
+				if count > limit {
+					break
+				}
+			}
+			if len(page) <= limit && after == page[len(page)-1] {
+				break
+			}
+		}
+
+		// One child past the limit was read to learn whether there is
+		// another page; drop it again
+		if len(keys)+len(dirs) > limit {
+			if len(dirs) > 0 && dirs[len(dirs)-1] == last {
+				dirs = dirs[:len(dirs)-1]
+			} else {
+				keys = keys[:len(keys)-1]
+			}
+			c.Header("X-Next-Cursor", lastChild(keys, dirs))
+		}
+		c.JSON(http.StatusOK, gin.H{"keys": keys, "dirs": dirs})
+	}
+}
+
+// lastChild returns the child that sorts last of keys and dirs.
+func lastChild(keys, dirs []string) string {
+	switch {
+	case len(keys) == 0:
+		return dirs[len(dirs)-1]
+	case len(dirs) == 0:
+		return keys[len(keys)-1]
+	}
+	return max(keys[len(keys)-1], dirs[len(dirs)-1])
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mailer sends email. It is an interface so the transport can be swapped, e.g.
+// for a stub that records messages.
+type mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// smtpMailer sends plain-text email through an SMTP server. Credentials are
+// optional; when given, they are sent with PLAIN authentication, which
+// net/smtp only allows over TLS or to localhost.
+type smtpMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Send delivers a message to a single recipient.
+func (m smtpMailer) Send(ctx context.Context, to, subject, body string) error {
+	// Refuse header injection through the recipient or subject
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return errors.New("invalid email header")
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		m.From, to, subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(body, "\n", "\r\n"))
+	return smtp.SendMail(m.Addr, auth, m.From, []string{to}, []byte(msg))
+}
+
+// newVerificationCode returns a random code for confirming an email address.
+// It is long enough that guessing it is hopeless, so attempts need no limit.
+func newVerificationCode() string {
+	buf := make([]byte, 10)
+	rand.Read(buf)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+}
+
+// sendVerificationCode emails the code confirming the address of a new bucket.
+func sendVerificationCode(ctx context.Context, mail mailer, email, bucketID, code string) error {
+	body := fmt.Sprintf(`A gokv bucket was created for this address (bucket ID %s).
+
+To start using it, confirm your address by sending this code to
+POST /bucket/verify with the bucket's token:
+
+    %s
+
+If you didn't create a bucket, you can ignore this email.
+`, bucketID, code)
+	return mail.Send(ctx, email, "Confirm your gokv bucket", body)
+}
+
+// verifyBucketRequest defines the structure for the /bucket/verify endpoint
+// request body.
+type verifyBucketRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// verifyBucketHandler activates a bucket with the code emailed to its owner.
+// It authenticates the token itself, since authMiddleware turns away tokens of
+// unverified buckets.
+func verifyBucketHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header format must be Bearer {token}"})
+			return
+		}
+
+		var req verifyBucketRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Code is required"})
+			return
+		}
+
+		if err := store.VerifyBucket(c.Request.Context(), token, strings.TrimSpace(req.Code)); err != nil {
+			switch {
+			case errors.Is(err, errNotFound):
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			case errors.Is(err, errInvalidCode):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid verification code"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify bucket"})
+				slog.ErrorContext(c.Request.Context(), "Error verifying bucket", "error", err)
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"verified": true})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// stubMailer records the messages sent through it instead of sending them,
+// or fails them with err.
+type stubMailer struct {
+	mu   sync.Mutex
+	sent []stubMessage
+	err  error
+}
+
+type stubMessage struct {
+	to, subject, body string
+}
+
+func (m *stubMailer) Send(_ context.Context, to, subject, body string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, stubMessage{to, subject, body})
+	return nil
+}
+
+// verificationCodePattern finds the code in a verification email, on a line
+// of its own.
+var verificationCodePattern = regexp.MustCompile(`\n    (\S+)\n`)
+
+// newVerifyRouter returns a router that creates buckets sending verification
+// codes through mail, verifies them, and serves their keys.
+func newVerifyRouter(t *testing.T, store Store, mail mailer) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/bucket", createBucketHandler(store, Limits{}, 0, mail))
+	router.POST("/bucket/verify", verifyBucketHandler(store))
+	router.GET("/kv/:key", authMiddleware(store), getHandler(store, false))
+	return router
+}
+
+// serveAs makes a request to router with token as its bearer token.
+func serveAs(router *gin.Engine, token, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestVerifyBucket(t *testing.T) {
+	mail := &stubMailer{}
+	router := newVerifyRouter(t, newTestStore(t, storeOptions{}), mail)
+
+	w := serveAs(router, "", http.MethodPost, "/bucket", `{"email":"owner@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+	}
+	var created struct {
+		BucketID string `json:"bucket_id"`
+		Token    string `json:"token"`
+		Verified bool   `json:"verified"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decoding bucket: %v", err)
+	}
+	if created.Verified {
+		t.Errorf("new bucket is verified, want unverified")
+	}
+
+	if len(mail.sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(mail.sent))
+	}
+	msg := mail.sent[0]
+	if msg.to != "owner@example.com" {
+		t.Errorf("email sent to %q, want %q", msg.to, "owner@example.com")
+	}
+	if !strings.Contains(msg.body, created.BucketID) {
+		t.Errorf("email doesn't mention bucket %s", created.BucketID)
+	}
+	match := verificationCodePattern.FindStringSubmatch(msg.body)
+	if match == nil {
+		t.Fatalf("no code in email %q", msg.body)
+	}
+	code := match[1]
+
+	// The token can't be used until the bucket is verified
+	if w := serveAs(router, created.Token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET before verifying status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if w := serveAs(router, created.Token, http.MethodPost, "/bucket/verify", `{"code":"WRONGCODE"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("verify with wrong code status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serveAs(router, created.Token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusForbidden {
+		t.Errorf("GET after wrong code status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := serveAs(router, "not-a-token", http.MethodPost, "/bucket/verify", `{"code":"`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("verify with wrong token status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if w := serveAs(router, created.Token, http.MethodPost, "/bucket/verify", `{"code":"`+code+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("verify status = %d, want %d; body %q", w.Code, http.StatusOK, w.Body.String())
+	}
+	if w := serveAs(router, created.Token, http.MethodGet, "/kv/k", ""); w.Code != http.StatusNotFound {
+		t.Errorf("GET after verifying status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// TestVerifyEmailFails checks that a bucket whose code couldn't be sent is
+// removed, leaving its address free to try again.
+func TestVerifyEmailFails(t *testing.T) {
+	mail := &stubMailer{err: errors.New("mail server down")}
+	router := newVerifyRouter(t, newTestStore(t, storeOptions{}), mail)
+
+	if w := serveAs(router, "", http.MethodPost, "/bucket", `{"email":"owner@example.com"}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("create status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	mail.err = nil
+	if w := serveAs(router, "", http.MethodPost, "/bucket", `{"email":"owner@example.com"}`); w.Code != http.StatusCreated {
+		t.Errorf("second create status = %d, want %d; body %q", w.Code, http.StatusCreated, w.Body.String())
+	}
+}
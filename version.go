@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo describes the running build. The commit and date recorded by the
+// Go toolchain are used when they weren't set with -ldflags.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	// SchemaVersion is the version of the database schema, if known.
+	SchemaVersion int `json:"schema_version,omitempty"`
+}
+
+// currentBuild returns the build information of the running binary.
+func currentBuild() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildDate: buildDate, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// buildInfoHandler reports which build is running, and the version of the
+// schema of store. It needs no token.
+func buildInfoHandler(store Store) gin.HandlerFunc {
+	info := currentBuild()
+	info.SchemaVersion = store.SchemaVersion()
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, info)
+	}
+}
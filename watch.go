@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// watchKeepAlive is how often an idle watch stream gets a comment, so proxies
+// don't time the connection out.
+const watchKeepAlive = 15 * time.Second
+
+// watchEvent is the data of a server-sent event. Value is omitted for deletes,
+// and for writes of values streamed to a file.
+type watchEvent struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+}
+
+// watchHandler streams changes to a key as server-sent events until the client
+// disconnects. Each write sends a "put" event with the new value and each
+// delete a "delete" event.
+func watchHandler(events *hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+		key := c.Param("key")
+
+		sub := events.subscribe(bucket, key)
+		defer events.unsubscribe(sub)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(watchKeepAlive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case <-ticker.C:
+				fmt.Fprint(c.Writer, ": keep-alive\n\n")
+			case ev, ok := <-sub.C:
+				if !ok {
+					// Dropped for falling behind, or shutting down; the
+					// client can reconnect
+					return
+				}
+				data := watchEvent{Key: key}
+				if ev.Type == eventPut && !ev.NoValue {
+					value := string(ev.Value)
+					data.Value = &value
+				}
+				payload, err := json.Marshal(data)
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", ev.Type, payload)
+			}
+			c.Writer.Flush()
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// webhookQueueSize is how many notifications may wait for delivery before
+	// new ones are dropped.
+	webhookQueueSize = 1024
+	// webhookWorkers is how many notifications are delivered concurrently.
+	webhookWorkers = 4
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 5 * time.Second
+	// webhookAttempts is how often a delivery is tried before giving up. The
+	// wait between attempts doubles each time, starting at webhookBackoff.
+	webhookAttempts = 4
+	webhookBackoff  = time.Second
+)
+
+// webhookPayload is the body POSTed to a bucket's webhook. Prefix is set when
+// every key starting with Key was deleted at once.
+type webhookPayload struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Event  string `json:"event"`
+	Prefix bool   `json:"prefix,omitempty"`
+}
+
+// webhookDelivery is a notification waiting to be delivered, and how many
+// attempts have been made at it so far.
+type webhookDelivery struct {
+	ev       event
+	attempts int
+}
+
+// webhookDispatcher delivers change events to bucket webhooks in the
+// background, so a slow or failing webhook never holds up a request.
+type webhookDispatcher struct {
+	store  Store
+	client *http.Client
+	queue  chan webhookDelivery
+	// backoff is the wait before the first retry of a delivery.
+	backoff time.Duration
+}
+
+// newWebhookDispatcher returns a dispatcher that delivers notifications once
+// run. Unless allowPrivate is set, it refuses to connect to loopback, private
+// and link-local addresses, whatever a webhook's host resolves to.
+func newWebhookDispatcher(store Store, allowPrivate bool) *webhookDispatcher {
+	dialer := &net.Dialer{Timeout: webhookTimeout}
+	if !allowPrivate {
+		dialer.Control = webhookDialControl
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would make the connection for us, out of reach of the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &webhookDispatcher{
+		store: store,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   webhookTimeout,
+			// A redirect is a failed delivery rather than a way to reach
+			// another host
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue:   make(chan webhookDelivery, webhookQueueSize),
+		backoff: webhookBackoff,
+	}
+}
+
+// enqueue queues ev for delivery without blocking. It is meant to be
+// registered as a hub listener.
+func (d *webhookDispatcher) enqueue(ev event) {
+	d.push(webhookDelivery{ev: ev})
+}
+
+func (d *webhookDispatcher) push(delivery webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		slog.Warn("Webhook queue full; dropping notification", "bucket", delivery.ev.Bucket, "key", delivery.ev.Key)
+	}
+}
+
+// run delivers queued notifications until ctx is cancelled, then waits for
+// the attempts in progress to end.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	var workers sync.WaitGroup
+	for range webhookWorkers {
+		workers.Go(func() {
+			for {
+				select {
+				case delivery := <-d.queue:
+					d.deliver(ctx, delivery)
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	workers.Wait()
+}
+
+// deliver makes an attempt at sending a notification to its bucket's webhook,
+// if it has one. A failed attempt is queued again after an exponential
+// backoff, rather than holding up the worker and every other bucket's
+// notifications behind it.
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery webhookDelivery) {
+	ev := delivery.ev
+	webhookURL, secret, err := d.store.Webhook(ctx, ev.Bucket)
+	if err != nil {
+		if !errors.Is(err, errNotFound) && ctx.Err() == nil {
+			slog.Error("Error looking up webhook", "bucket", ev.Bucket, "error", err)
+		}
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{Bucket: ev.Bucket, Key: ev.Key, Event: ev.Type, Prefix: ev.Prefix})
+	if err != nil {
+		slog.Error("Error encoding webhook payload", "bucket", ev.Bucket, "error", err)
+		return
+	}
+
+	err = d.post(ctx, webhookURL, signWebhook(secret, body), body)
+	if err == nil || ctx.Err() != nil {
+		return
+	}
+	delivery.attempts++
+	if delivery.attempts == webhookAttempts {
+		slog.Warn("Giving up on webhook delivery", "bucket", ev.Bucket, "key", ev.Key, "attempts", delivery.attempts, "error", err)
+		return
+	}
+	time.AfterFunc(d.backoff<<(delivery.attempts-1), func() {
+		if ctx.Err() == nil {
+			d.push(delivery)
+		}
+	})
+}
+
+// post makes a single delivery attempt.
+func (d *webhookDispatcher) post(ctx context.Context, webhookURL, signature string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gokv-Signature", signature)
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// errPrivateWebhookAddr is returned for webhooks that would reach the
+// server's own network rather than the internet.
+var errPrivateWebhookAddr = errors.New("webhook address is loopback, private or link-local")
+
+// publicAddr reports whether ip is an address on the internet, as opposed to
+// a loopback, private, link-local, multicast or unspecified one.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// webhookDialControl refuses connections to addresses that aren't public.
+// Checking the address actually dialed, rather than the URL, means a host
+// that resolves to an internal address later on can't slip past.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return errPrivateWebhookAddr
+	}
+	return nil
+}
+
+// checkWebhookHost returns errPrivateWebhookAddr if host is, or resolves to,
+// an address that isn't public.
+func checkWebhookHost(ctx context.Context, host string) error {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !publicAddr(ip) {
+			return errPrivateWebhookAddr
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !publicAddr(ip) {
+			return errPrivateWebhookAddr
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the X-Gokv-Signature header for body: the hex HMAC-SHA256
+// of the body keyed with the bucket's webhook secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// setWebhookRequest defines the structure for the /bucket/webhook endpoint
+// request body.
+type setWebhookRequest struct {
+	URL string `json:"url" binding:"required"`
+}
+
+// setWebhookHandler sets the URL notified whenever a key in the bucket is
+// written or deleted. A new signing secret is generated and returned each time.
+// Unless allowPrivate is set, URLs whose host is or resolves to a loopback,
+// private or link-local address are refused, so a bucket can't use the server
+// to reach its internal network.
+func setWebhookHandler(store Store, allowPrivate bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+
+		var req setWebhookRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "URL is required"})
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "URL must be an absolute http or https URL"})
+			return
+		}
+		if !allowPrivate {
+			err := checkWebhookHost(c.Request.Context(), u.Hostname())
+			if errors.Is(err, errPrivateWebhookAddr) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "URL must not point at a loopback, private or link-local address"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Could not resolve the URL's host"})
+				return
+			}
+		}
+
+		buf := make([]byte, 32)
+		rand.Read(buf)
+		secret := hex.EncodeToString(buf)
+
+		if err := store.SetWebhook(c.Request.Context(), bucket, req.URL, secret); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set webhook"})
+			slog.ErrorContext(c.Request.Context(), "Error setting webhook", "bucket", bucket, "error", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"url": req.URL, "secret": secret})
+	}
+}
+
+// deleteWebhookHandler stops notifications for the bucket.
+func deleteWebhookHandler(store Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bucket := c.GetString("bucket")
+
+		if err := store.SetWebhook(c.Request.Context(), bucket, "", ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+			slog.ErrorContext(c.Request.Context(), "Error deleting webhook", "bucket", bucket, "error", err)
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
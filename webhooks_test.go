@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webhookReceiver records the notifications POSTed to it. It answers the
+// first failures attempts with 500 and closes done on the first success.
+type webhookReceiver struct {
+	mu         sync.Mutex
+	failures   int
+	attempts   int
+	bodies     [][]byte
+	signatures []string
+	done       chan struct{}
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if r.attempts <= r.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get("X-Gokv-Signature"))
+	close(r.done)
+}
+
+// newWebhookTest starts a dispatcher for a bucket whose webhook is receiver,
+// with a retry backoff short enough for tests, and returns the bucket.
+func newWebhookTest(t *testing.T, receiver *webhookReceiver) (*webhookDispatcher, string) {
+	t.Helper()
+	ctx := context.Background()
+	store := newTestStore(t, storeOptions{})
+	bucket, _, err := store.CreateBucket(ctx, "hooks@example.com", "", Limits{}, "")
+	if err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	if err := store.SetWebhook(ctx, bucket, server.URL, "secret"); err != nil {
+		t.Fatalf("setting webhook: %v", err)
+	}
+
+	// The receiver listens on loopback, so it is only reachable when
+	// private addresses are allowed
+	d := newWebhookDispatcher(store, true)
+	d.backoff = time.Millisecond
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		d.run(runCtx)
+		close(stopped)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return d, bucket
+}
+
+func TestWebhookSigned(t *testing.T) {
+	receiver := &webhookReceiver{done: make(chan struct{})}
+	d, bucket := newWebhookTest(t, receiver)
+
+	d.enqueue(event{Type: eventPut, Bucket: bucket, Key: "k"})
+	select {
+	case <-receiver.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	body := receiver.bodies[0]
+	if got, want := receiver.signatures[0], signWebhook("secret", body); got != want {
+		t.Errorf("X-Gokv-Signature = %q, want %q", got, want)
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	if want := (webhookPayload{Bucket: bucket, Key: "k", Event: eventPut}); payload != want {
+		t.Errorf("payload = %+v, want %+v", payload, want)
+	}
+}
+
+func TestWebhookRetried(t *testing.T) {
+	receiver := &webhookReceiver{failures: webhookAttempts - 1, done: make(chan struct{})}
+	d, bucket := newWebhookTest(t, receiver)
+
+	d.enqueue(event{Type: eventDelete, Bucket: bucket, Key: "k"})
+	select {
+	case <-receiver.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't delivered")
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.attempts != webhookAttempts {
+		t.Errorf("attempts = %d, want %d", receiver.attempts, webhookAttempts)
+	}
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+	receiver := &webhookReceiver{failures: webhookAttempts + 1, done: make(chan struct{})}
+	d, bucket := newWebhookTest(t, receiver)
+
+	d.enqueue(event{Type: eventPut, Bucket: bucket, Key: "k"})
+	// Give the retries, a millisecond or so apart, ample time to run out
+	time.Sleep(200 * time.Millisecond)
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if receiver.attempts != webhookAttempts {
+		t.Errorf("attempts = %d, want %d", receiver.attempts, webhookAttempts)
+	}
+}
+
+func TestWebhookDialRefusesPrivateAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	d := newWebhookDispatcher(nil, false)
+	err := d.post(context.Background(), server.URL, "", nil)
+	if !errors.Is(err, errPrivateWebhookAddr) {
+		t.Errorf("post to %s: err = %v, want errPrivateWebhookAddr", server.URL, err)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddr(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSetWebhookValidatesURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := newTestStore(t, storeOptions{})
+	bucket, _, err := store.CreateBucket(context.Background(), "hooks@example.com", "", Limits{}, "")
+	if err != nil {
+		t.Fatalf("creating bucket: %v", err)
+	}
+	router := gin.New()
+	router.POST("/bucket/webhook", func(c *gin.Context) { c.Set("bucket", bucket) }, setWebhookHandler(store, false))
+
+	tests := []struct {
+		url  string
+		want int
+	}{
+		{"ftp://example.com/hook", http.StatusBadRequest},
+		{"file:///etc/passwd", http.StatusBadRequest},
+		{"/hook", http.StatusBadRequest},
+		{"http://127.0.0.1:8080/hook", http.StatusBadRequest},
+		{"http://[::1]/hook", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data", http.StatusBadRequest},
+		{"https://10.0.0.5/hook", http.StatusBadRequest},
+		{"https://192.168.0.10/hook", http.StatusBadRequest},
+		{"https://93.184.216.34/hook", http.StatusOK},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(setWebhookRequest{URL: tt.url})
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/bucket/webhook", strings.NewReader(string(body))))
+		if w.Code != tt.want {
+			t.Errorf("setting %s: status = %d, want %d; body %q", tt.url, w.Code, tt.want, w.Body.String())
+		}
+	}
+}